@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"port-knocker/internal"
+)
+
+// ExitCodeError возвращается, когда команда после knocking завершилась с ненулевым кодом:
+// port-knocker завершается с тем же кодом, как если бы команда была запущена напрямую
+type ExitCodeError struct {
+	Code int
+}
+
+func (e *ExitCodeError) Error() string {
+	return fmt.Sprintf("команда завершилась с кодом %d", e.Code)
+}
+
+// runExec выполняет команды после успешного knocking. Команда из командной строки (--exec -- cmd)
+// заменяет exec из конфигурации и получает данные первой цели; команды из конфигурации
+// выполняются по порядку целей до первой ошибки
+func runExec(config *internal.Config, report *internal.Report, argv []string) error {
+	if len(argv) > 0 {
+		var result *internal.TargetResult
+		if len(report.Targets) > 0 {
+			result = report.Targets[0]
+		}
+		command, err := internal.ArgsCommand(argv, internal.NewExecData(config.Targets[0], result))
+		if err != nil {
+			return err
+		}
+		return runAttached(command)
+	}
+
+	for i, target := range config.Targets {
+		if target.Exec == "" || i >= len(report.Targets) {
+			continue
+		}
+		command, err := internal.ShellCommand(target.Exec, internal.NewExecData(target, report.Targets[i]))
+		if err != nil {
+			return fmt.Errorf("exec цели %s: %w", target.Host, err)
+		}
+		if err := runAttached(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runAttached запускает команду с stdin/stdout/stderr текущего процесса.
+// Контекст не используется: Ctrl+C получает сама команда (например, ssh), а не port-knocker
+func runAttached(command *exec.Cmd) error {
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	err := command.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitCodeError{Code: exitErr.ExitCode()}
+	}
+	if err != nil {
+		return fmt.Errorf("не удалось выполнить %s: %w", command.Path, err)
+	}
+	return nil
+}
+
+// hasExec сообщает, задана ли хотя бы у одной цели команда exec
+func hasExec(config *internal.Config) bool {
+	for _, target := range config.Targets {
+		if target.Exec != "" {
+			return true
+		}
+	}
+	return false
+}
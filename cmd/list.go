@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"port-knocker/internal"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Показать цели конфигурации в виде таблицы",
+	Long: `Выводит цели из конфигурационного файла (в том числе зашифрованного) без расшифровки на диск:
+имя, метки, хост, протокол, порты, задержку и шлюз. Учитывает --output json|yaml.`,
+	Args: cobra.NoArgs,
+	RunE: runList,
+}
+
+var showCmd = &cobra.Command{
+	Use:   "show <имя цели>",
+	Short: "Показать цель конфигурации полностью",
+	Long: `Выводит все параметры цели с указанным именем в формате YAML.
+Ключи SPA и секрет TOTP скрыты, если не указан --show-secrets.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runShow,
+}
+
+var showSecrets bool
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(showCmd)
+	showCmd.Flags().BoolVar(&showSecrets, "show-secrets", false, "Показать ключи и секреты как есть")
+}
+
+// listDocument описывает цель в выводе list --output json|yaml
+type listDocument struct {
+	Name     string   `json:"name,omitempty" yaml:"name,omitempty"`
+	Tags     []string `json:"tags,omitempty" yaml:"tags,omitempty,flow"`
+	Host     string   `json:"host" yaml:"host"`
+	Protocol string   `json:"protocol" yaml:"protocol"`
+	Ports    string   `json:"ports" yaml:"ports"`
+	Delay    string   `json:"delay" yaml:"delay"`
+	Gateway  string   `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+}
+
+func runList(cmd *cobra.Command, args []string) error {
+	if err := validateOutputFormat(); err != nil {
+		return err
+	}
+	config, err := loadConfigForInspect()
+	if err != nil {
+		return err
+	}
+
+	docs := []listDocument{}
+	for _, target := range config.Targets {
+		docs = append(docs, listDocument{
+			Name:     target.Name,
+			Tags:     target.Tags,
+			Host:     target.Host,
+			Protocol: target.DisplayProtocol(),
+			Ports:    describePorts(target),
+			Delay:    time.Duration(target.Delay).String(),
+			Gateway:  target.Gateway,
+		})
+	}
+
+	if machineOutput() {
+		return writeDocument(os.Stdout, docs)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ИМЯ\tМЕТКИ\tХОСТ\tПРОТОКОЛ\tПОРТЫ\tЗАДЕРЖКА\tШЛЮЗ")
+	for _, doc := range docs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			orDash(doc.Name), orDash(strings.Join(doc.Tags, ",")), doc.Host, doc.Protocol, doc.Ports, doc.Delay, orDash(doc.Gateway))
+	}
+	return w.Flush()
+}
+
+func runShow(cmd *cobra.Command, args []string) error {
+	config, err := loadConfigForInspect()
+	if err != nil {
+		return err
+	}
+
+	targets, err := config.Select(args, nil)
+	if err != nil {
+		return err
+	}
+	if !showSecrets {
+		for i := range targets {
+			targets[i] = targets[i].Redacted()
+		}
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(targets)
+}
+
+// loadConfigForInspect загружает конфигурацию для list/show; сообщения о расшифровке уходят в stderr
+func loadConfigForInspect() (*internal.Config, error) {
+	if configFile == "" {
+		return nil, fmt.Errorf("необходимо указать файл конфигурации (-c)")
+	}
+	knocker := internal.NewPortKnocker()
+	knocker.SetOutput(os.Stderr)
+	config, err := knocker.LoadConfig(configFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка загрузки конфигурации: %w", err)
+	}
+	return config, nil
+}
+
+// describePorts описывает последовательность цели для таблицы
+func describePorts(target internal.Target) string {
+	if target.TOTP != nil {
+		return fmt.Sprintf("totp %d-%d", target.TOTP.PortMin, target.TOTP.PortMax)
+	}
+	if len(target.Ports) == 0 && strings.EqualFold(target.Protocol, "spa") {
+		return strconv.Itoa(internal.DefaultSPAPort)
+	}
+	ports := make([]string, len(target.Ports))
+	for i, port := range target.Ports {
+		ports[i] = port.String()
+	}
+	return strings.Join(ports, ",")
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
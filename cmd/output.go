@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"port-knocker/internal"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Форматы машиночитаемого вывода (--output)
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// machineOutput сообщает, нужно ли печатать в stdout документ вместо текста для человека
+func machineOutput() bool {
+	return outputFormat == outputJSON || outputFormat == outputYAML
+}
+
+// validateOutputFormat проверяет значение флага --output
+func validateOutputFormat() error {
+	switch outputFormat {
+	case "", outputText, outputJSON, outputYAML:
+		return nil
+	default:
+		return fmt.Errorf("неподдерживаемый формат вывода '%s', ожидается text, json или yaml", outputFormat)
+	}
+}
+
+// writeDocument печатает v в выбранном машиночитаемом формате
+func writeDocument(w io.Writer, v any) error {
+	switch outputFormat {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case outputYAML:
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		defer encoder.Close()
+		return encoder.Encode(v)
+	default:
+		return fmt.Errorf("неподдерживаемый формат вывода '%s'", outputFormat)
+	}
+}
+
+// runDocument описывает результат запуска knocking для --output json|yaml
+type runDocument struct {
+	Success    bool             `json:"success" yaml:"success"`
+	Error      string           `json:"error,omitempty" yaml:"error,omitempty"`
+	StartedAt  time.Time        `json:"started_at" yaml:"started_at"`
+	FinishedAt time.Time        `json:"finished_at" yaml:"finished_at"`
+	DurationMs int64            `json:"duration_ms" yaml:"duration_ms"`
+	Targets    []targetDocument `json:"targets" yaml:"targets"`
+}
+
+type targetDocument struct {
+	Name       string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Host       string            `json:"host" yaml:"host"`
+	Protocol   string            `json:"protocol" yaml:"protocol"`
+	Ports      []int             `json:"ports" yaml:"ports,flow"`
+	Success    bool              `json:"success" yaml:"success"`
+	Error      string            `json:"error,omitempty" yaml:"error,omitempty"`
+	StartedAt  time.Time         `json:"started_at" yaml:"started_at"`
+	FinishedAt time.Time         `json:"finished_at" yaml:"finished_at"`
+	DurationMs int64             `json:"duration_ms" yaml:"duration_ms"`
+	Packets    []packetDocument  `json:"packets" yaml:"packets"`
+	Verify     *verifyDocument   `json:"verify,omitempty" yaml:"verify,omitempty"`
+	Attempts   []attemptDocument `json:"attempts" yaml:"attempts"`
+}
+
+type attemptDocument struct {
+	Number     int              `json:"number" yaml:"number"`
+	Success    bool             `json:"success" yaml:"success"`
+	Error      string           `json:"error,omitempty" yaml:"error,omitempty"`
+	StartedAt  time.Time        `json:"started_at" yaml:"started_at"`
+	FinishedAt time.Time        `json:"finished_at" yaml:"finished_at"`
+	DurationMs int64            `json:"duration_ms" yaml:"duration_ms"`
+	Packets    []packetDocument `json:"packets" yaml:"packets"`
+	Verify     *verifyDocument  `json:"verify,omitempty" yaml:"verify,omitempty"`
+}
+
+type packetDocument struct {
+	Port       int       `json:"port" yaml:"port"`
+	Protocol   string    `json:"protocol" yaml:"protocol"`
+	RemoteAddr string    `json:"remote_addr,omitempty" yaml:"remote_addr,omitempty"`
+	LocalAddr  string    `json:"local_addr,omitempty" yaml:"local_addr,omitempty"`
+	Outcome    string    `json:"outcome" yaml:"outcome"`
+	Sent       bool      `json:"sent" yaml:"sent"`
+	PayloadLen int       `json:"payload_bytes,omitempty" yaml:"payload_bytes,omitempty"`
+	Raw        bool      `json:"raw,omitempty" yaml:"raw,omitempty"`
+	Error      string    `json:"error,omitempty" yaml:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at" yaml:"started_at"`
+	FinishedAt time.Time `json:"finished_at" yaml:"finished_at"`
+	DurationMs int64     `json:"duration_ms" yaml:"duration_ms"`
+}
+
+type verifyDocument struct {
+	Address    string `json:"address" yaml:"address"`
+	Protocol   string `json:"protocol" yaml:"protocol"`
+	Reachable  bool   `json:"reachable" yaml:"reachable"`
+	Attempts   int    `json:"attempts" yaml:"attempts"`
+	Banner     string `json:"banner,omitempty" yaml:"banner,omitempty"`
+	Error      string `json:"error,omitempty" yaml:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms" yaml:"duration_ms"`
+}
+
+// newRunDocument собирает документ из отчета; report может быть nil, если до knocking не дошло
+func newRunDocument(report *internal.Report, runErr error) runDocument {
+	doc := runDocument{
+		Success: runErr == nil,
+		Error:   errorString(runErr),
+		Targets: []targetDocument{},
+	}
+	if report == nil {
+		now := time.Now()
+		doc.StartedAt, doc.FinishedAt = now, now
+		return doc
+	}
+
+	doc.StartedAt = report.StartedAt
+	doc.FinishedAt = report.FinishedAt
+	doc.DurationMs = report.FinishedAt.Sub(report.StartedAt).Milliseconds()
+
+	for _, target := range report.Targets {
+		targetDoc := targetDocument{
+			Name:       target.Name,
+			Host:       target.Host,
+			Protocol:   target.Protocol,
+			Ports:      target.Ports,
+			Success:    target.Err == nil,
+			Error:      errorString(target.Err),
+			StartedAt:  target.StartedAt,
+			FinishedAt: target.FinishedAt,
+			DurationMs: target.FinishedAt.Sub(target.StartedAt).Milliseconds(),
+			Packets:    newPacketDocuments(target.Packets),
+			Verify:     newVerifyDocument(target.Verify),
+			Attempts:   []attemptDocument{},
+		}
+		for _, attempt := range target.Attempts {
+			targetDoc.Attempts = append(targetDoc.Attempts, attemptDocument{
+				Number:     attempt.Number,
+				Success:    attempt.Err == nil,
+				Error:      errorString(attempt.Err),
+				StartedAt:  attempt.StartedAt,
+				FinishedAt: attempt.FinishedAt,
+				DurationMs: attempt.FinishedAt.Sub(attempt.StartedAt).Milliseconds(),
+				Packets:    newPacketDocuments(attempt.Packets),
+				Verify:     newVerifyDocument(attempt.Verify),
+			})
+		}
+		doc.Targets = append(doc.Targets, targetDoc)
+	}
+
+	return doc
+}
+
+// planDocument описывает план --dry-run для --output json|yaml
+type planDocument struct {
+	Name      string             `json:"name,omitempty" yaml:"name,omitempty"`
+	Host      string             `json:"host" yaml:"host"`
+	Protocol  string             `json:"protocol" yaml:"protocol"`
+	Wait      bool               `json:"wait_connection" yaml:"wait_connection"`
+	Interface string             `json:"interface,omitempty" yaml:"interface,omitempty"`
+	Gateway   string             `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	SamePort  bool               `json:"same_source_port,omitempty" yaml:"same_source_port,omitempty"`
+	Steps     []planStepDocument `json:"steps" yaml:"steps"`
+	Verify    string             `json:"verify,omitempty" yaml:"verify,omitempty"`
+	Retries   int                `json:"retries,omitempty" yaml:"retries,omitempty"`
+	Exec      string             `json:"exec,omitempty" yaml:"exec,omitempty"`
+	Error     string             `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type planStepDocument struct {
+	OffsetMs   int64  `json:"offset_ms" yaml:"offset_ms"`
+	DelayMs    int64  `json:"delay_ms" yaml:"delay_ms"`
+	JitterMs   int64  `json:"jitter_ms,omitempty" yaml:"jitter_ms,omitempty"`
+	Payload    string `json:"payload,omitempty" yaml:"payload,omitempty"`
+	RawFlags   string `json:"raw_flags,omitempty" yaml:"raw_flags,omitempty"`
+	Encoding   string `json:"icmp_encode,omitempty" yaml:"icmp_encode,omitempty"`
+	Port       int    `json:"port" yaml:"port"`
+	Protocol   string `json:"protocol" yaml:"protocol"`
+	RemoteAddr string `json:"remote_addr" yaml:"remote_addr"`
+	LocalAddr  string `json:"local_addr,omitempty" yaml:"local_addr,omitempty"`
+}
+
+func newPlanDocuments(plans []*internal.TargetPlan) []planDocument {
+	docs := []planDocument{}
+	for _, plan := range plans {
+		doc := planDocument{
+			Name:      plan.Name,
+			Host:      plan.Host,
+			Protocol:  plan.Protocol,
+			Wait:      plan.Wait,
+			Interface: plan.Interface,
+			Gateway:   plan.Gateway,
+			SamePort:  plan.SamePort,
+			Steps:     []planStepDocument{},
+			Verify:    plan.Verify,
+			Retries:   plan.Retries,
+			Exec:      plan.Exec,
+			Error:     errorString(plan.Err),
+		}
+		for _, step := range plan.Steps {
+			doc.Steps = append(doc.Steps, planStepDocument{
+				OffsetMs:   step.Offset.Milliseconds(),
+				DelayMs:    step.Delay.Milliseconds(),
+				JitterMs:   step.Jitter.Milliseconds(),
+				Payload:    step.Payload,
+				RawFlags:   step.RawFlags,
+				Encoding:   step.Encoding,
+				Port:       step.Port,
+				Protocol:   step.Protocol,
+				RemoteAddr: step.RemoteAddr,
+				LocalAddr:  step.LocalAddr,
+			})
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func newPacketDocuments(packets []internal.PacketResult) []packetDocument {
+	docs := []packetDocument{}
+	for _, packet := range packets {
+		docs = append(docs, packetDocument{
+			Port:       packet.Port,
+			Protocol:   packet.Protocol,
+			RemoteAddr: packet.RemoteAddr,
+			LocalAddr:  packet.LocalAddr,
+			Outcome:    string(packet.Outcome),
+			Sent:       packet.Sent(),
+			PayloadLen: packet.PayloadSize,
+			Raw:        packet.Raw,
+			Error:      errorString(packet.Err),
+			StartedAt:  packet.StartedAt,
+			FinishedAt: packet.FinishedAt,
+			DurationMs: packet.FinishedAt.Sub(packet.StartedAt).Milliseconds(),
+		})
+	}
+	return docs
+}
+
+func newVerifyDocument(verify *internal.VerifyResult) *verifyDocument {
+	if verify == nil {
+		return nil
+	}
+	return &verifyDocument{
+		Address:    verify.Address,
+		Protocol:   verify.Protocol,
+		Reachable:  verify.Reachable,
+		Attempts:   verify.Attempts,
+		Banner:     verify.Banner,
+		Error:      errorString(verify.Err),
+		DurationMs: verify.FinishedAt.Sub(verify.StartedAt).Milliseconds(),
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"port-knocker/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var proxyCmd = &cobra.Command{
+	Use:   "proxy <host> <port>",
+	Short: "Простучать хост и передать соединение через stdin/stdout (ProxyCommand для ssh)",
+	Long: `Находит в конфигурации цели с указанным хостом, выполняет их последовательности,
+затем подключается к host:port и передает данные между stdin/stdout и сокетом.
+
+Пример для ~/.ssh/config:
+
+  Host server.example.com
+      ProxyCommand port-knocker proxy -c ~/.config/port-knocker.yaml %h %p`,
+	Args: cobra.ExactArgs(2),
+	RunE: runProxy,
+}
+
+var proxyConnectTimeout time.Duration
+
+func init() {
+	rootCmd.AddCommand(proxyCmd)
+	proxyCmd.Flags().DurationVar(&proxyConnectTimeout, "connect-timeout", 10*time.Second, "Таймаут подключения к порту после knocking")
+}
+
+func runProxy(cmd *cobra.Command, args []string) error {
+	if configFile == "" {
+		return fmt.Errorf("необходимо указать файл конфигурации (-c)")
+	}
+	host, port := args[0], args[1]
+
+	// stdout принадлежит ssh, поэтому все сообщения - только в stderr
+	knocker := internal.NewPortKnocker()
+	knocker.SetOutput(os.Stderr)
+
+	config, err := knocker.LoadConfig(configFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки конфигурации: %w", err)
+	}
+
+	targets := config.TargetsForHost(host)
+	if len(targets) == 0 {
+		return fmt.Errorf("в конфигурации нет целей для хоста %s", host)
+	}
+	config.Targets = targets
+	if knockInterface != "" {
+		applyInterface(config)
+	}
+
+	if _, err := knocker.ExecuteWithConfigContext(cmd.Context(), config, verbose, waitConnection); err != nil {
+		return err
+	}
+
+	dialer := &net.Dialer{Timeout: proxyConnectTimeout}
+	conn, err := dialer.DialContext(cmd.Context(), "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return fmt.Errorf("не удалось подключиться после knocking: %w", err)
+	}
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Соединение с %s установлено\n", conn.RemoteAddr())
+	}
+
+	return internal.Relay(conn, os.Stdin, os.Stdout)
+}
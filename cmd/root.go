@@ -1,9 +1,15 @@
 package cmd
 
-import (	
+import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"port-knocker/internal"
@@ -18,27 +24,39 @@ var (
 	waitConnection bool
 	targetsInline  string
 	defaultDelay   string
+	outputFormat   string
+	parallel       int
+	execAfter      bool
+	selectTags     []string
+	dryRun         bool
+	knockInterface string
 )
 
 var rootCmd = &cobra.Command{
-	Use:   "port-knocker",
+	Use:   "port-knocker [имя цели...]",
 	Short: "Утилита для отправки port knocking пакетов",
 	Long: `Port Knocker - утилита для отправки TCP/UDP пакетов на определенные порты
 в заданной последовательности для активации портов на удаленных серверах.
 
 Поддерживает:
-- TCP и UDP протоколы
+- TCP, UDP и ICMP протоколы, IPv4 и IPv6
 - Зашифрованные конфигурационные файлы
 - Автоматическое определение зашифрованных файлов
 - Ключи шифрования из файла или системной переменной
 - Настройка шлюза для отправки пакетов
 - Гибкая настройка ожидания соединения
-- Инлайн задание целей без конфигурационного файла`,
+- Инлайн задание целей без конфигурационного файла
+- Запуск команды после успешного knocking (--exec -- ssh user@host)`,
+	Args: cobra.ArbitraryArgs,
 	RunE: runKnock,
 }
 
 func Execute() error {
-	return rootCmd.Execute()
+	// Ctrl+C и SIGTERM отменяют контекст и прерывают последовательность между пакетами
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return rootCmd.ExecuteContext(ctx)
 }
 
 func init() {
@@ -48,6 +66,12 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&waitConnection, "wait-connection", "w", false, "Ждать установления соединения (по умолчанию не ждать)")
 	rootCmd.PersistentFlags().StringVarP(&targetsInline, "targets", "t", "", "Инлайн цели в формате [proto]:[host]:[port];[proto]:[host]:[port]")
 	rootCmd.PersistentFlags().StringVarP(&defaultDelay, "delay", "d", "1s", "Задержка между пакетами (по умолчанию 1s)")
+	rootCmd.PersistentFlags().IntVarP(&parallel, "parallel", "p", 0, "Сколько целей обрабатывать одновременно (переопределяет parallel из конфигурации)")
+	rootCmd.PersistentFlags().StringVar(&knockInterface, "interface", "", "Отправлять пакеты через этот сетевой интерфейс (переопределяет interface из конфигурации)")
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output", outputText, "Формат вывода результата: text, json или yaml (текст для человека уходит в stderr)")
+	rootCmd.Flags().StringSliceVar(&selectTags, "tag", nil, "Обработать только цели с этой меткой (можно повторять или перечислить через запятую)")
+	rootCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Показать план отправки пакетов (адреса и время) ничего не отправляя")
+	rootCmd.Flags().BoolVar(&execAfter, "exec", false, "После успешного knocking выполнить команду, указанную после --, и вернуть ее код")
 
 	// НЕ делаем config глобально обязательным - проверяем в runKnock
 }
@@ -62,19 +86,117 @@ func runKnock(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("нельзя одновременно использовать файл конфигурации (-c) и инлайн цели (-t)")
 	}
 
+	if err := validateOutputFormat(); err != nil {
+		return err
+	}
+
+	// Команда для --exec передается после "--": port-knocker -c cfg.yaml --exec -- ssh user@host
+	var execArgv []string
+	if dash := cmd.ArgsLenAtDash(); dash >= 0 {
+		if !execAfter {
+			return fmt.Errorf("аргументы после -- используются только вместе с --exec")
+		}
+		execArgv = args[dash:]
+		args = args[:dash]
+	}
+	if execAfter && len(execArgv) == 0 {
+		return fmt.Errorf("для --exec укажите команду после --, например: --exec -- ssh user@host")
+	}
+	// Остальные аргументы - имена целей из конфигурации
+	if targetsInline != "" && (len(args) > 0 || len(selectTags) > 0) {
+		return fmt.Errorf("выбор целей по имени или --tag доступен только с файлом конфигурации (-c)")
+	}
+
 	knocker := internal.NewPortKnocker()
+	if machineOutput() {
+		// stdout занят документом, сообщения для человека уходят в stderr
+		knocker.SetOutput(os.Stderr)
+	}
+
+	var config *internal.Config
+	var err error
 
 	// Если используем инлайн цели
 	if targetsInline != "" {
-		config, err := parseInlineTargets(targetsInline, defaultDelay)
+		config, err = parseInlineTargets(targetsInline, defaultDelay)
 		if err != nil {
 			return fmt.Errorf("ошибка разбора инлайн целей: %w", err)
 		}
-		return knocker.ExecuteWithConfig(config, verbose, waitConnection)
+	} else {
+		// Иначе используем файл конфигурации
+		config, err = knocker.LoadConfig(configFile, keyFile)
+		if err != nil {
+			err = fmt.Errorf("ошибка загрузки конфигурации: %w", err)
+		}
+	}
+
+	if config != nil && err == nil {
+		config.Targets, err = config.Select(args, selectTags)
+	}
+
+	// Флаг --parallel переопределяет значение из конфигурации
+	if config != nil && cmd.Flags().Changed("parallel") {
+		if parallel < 0 {
+			return fmt.Errorf("значение --parallel не может быть отрицательным: %d", parallel)
+		}
+		config.Parallel = parallel
+	}
+
+	// Флаг --interface переопределяет интерфейс всех целей
+	if config != nil && knockInterface != "" {
+		applyInterface(config)
+	}
+
+	if dryRun {
+		if err != nil {
+			return err
+		}
+		return printPlan(cmd, knocker, config)
+	}
+
+	if config != nil && machineOutput() && (len(execArgv) > 0 || hasExec(config)) {
+		return fmt.Errorf("exec нельзя использовать вместе с --output %s: stdout занят документом", outputFormat)
+	}
+
+	var report *internal.Report
+	if err == nil {
+		report, err = knocker.ExecuteWithConfigContext(cmd.Context(), config, verbose, waitConnection)
+	}
+
+	if machineOutput() {
+		if writeErr := writeDocument(os.Stdout, newRunDocument(report, err)); writeErr != nil {
+			return fmt.Errorf("не удалось вывести результат: %w", writeErr)
+		}
+		return err
+	}
+
+	// В подробном режиме печатаем сводку по каждому отправленному пакету
+	if verbose && report != nil {
+		fmt.Println()
+		report.WriteSummary(os.Stdout)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Код возврата команды становится кодом возврата port-knocker, без лишних сообщений
+	cmd.SilenceUsage = true
+	if err := runExec(config, report, execArgv); err != nil {
+		var exitErr *ExitCodeError
+		if errors.As(err, &exitErr) {
+			cmd.SilenceErrors = true
+		}
+		return err
 	}
+	return nil
+}
 
-	// Иначе используем файл конфигурации
-	return knocker.Execute(configFile, keyFile, verbose, waitConnection)
+// applyInterface задает всем целям интерфейс из флага --interface
+func applyInterface(config *internal.Config) {
+	for i := range config.Targets {
+		config.Targets[i].Interface = knockInterface
+	}
 }
 
 // parseInlineTargets разбирает строку инлайн целей в Config
@@ -98,18 +220,19 @@ func parseInlineTargets(targetsStr, delayStr string) (*internal.Config, error) {
 			continue
 		}
 
-		// Разбираем формат [proto]:[host]:[port]
-		parts := strings.Split(targetStr, ":")
-		if len(parts) != 3 {
-			return nil, fmt.Errorf("неверный формат цели '%s', ожидается [proto]:[host]:[port]", targetStr)
+		// Разбираем формат [proto]:[host]:[port]; IPv6 адрес записывается в скобках: tcp:[2001:db8::1]:22
+		protocol, hostPort, _ := strings.Cut(targetStr, ":")
+		host, portStr, err := net.SplitHostPort(strings.TrimSpace(hostPort))
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("неверный формат цели '%s', ожидается [proto]:[host]:[port], IPv6 в скобках: tcp:[2001:db8::1]:22", targetStr)
 		}
 
-		protocol := strings.TrimSpace(parts[0])
-		host := strings.TrimSpace(parts[1])
-		portStr := strings.TrimSpace(parts[2])
+		protocol = strings.TrimSpace(protocol)
+		host = strings.TrimSpace(host)
+		portStr = strings.TrimSpace(portStr)
 
 		// Проверяем протокол
-		if protocol != "tcp" && protocol != "udp" {
+		if protocol != "tcp" && protocol != "udp" && protocol != "icmp" {
 			return nil, fmt.Errorf("неподдерживаемый протокол '%s' в цели '%s'", protocol, targetStr)
 		}
 
@@ -126,7 +249,7 @@ func parseInlineTargets(targetsStr, delayStr string) (*internal.Config, error) {
 		// Создаем цель
 		target := internal.Target{
 			Host:           host,
-			Ports:          []int{port},
+			Ports:          []internal.PortSpec{{Port: port}},
 			Protocol:       protocol,
 			Delay:          internal.Duration(delay),
 			WaitConnection: false,
@@ -142,3 +265,16 @@ func parseInlineTargets(targetsStr, delayStr string) (*internal.Config, error) {
 
 	return config, nil
 }
+
+// printPlan выводит план --dry-run вместо отправки пакетов
+func printPlan(cmd *cobra.Command, knocker *internal.PortKnocker, config *internal.Config) error {
+	plans, err := knocker.PlanConfig(cmd.Context(), config, waitConnection)
+	if machineOutput() {
+		if writeErr := writeDocument(os.Stdout, newPlanDocuments(plans)); writeErr != nil {
+			return fmt.Errorf("не удалось вывести план: %w", writeErr)
+		}
+		return err
+	}
+	internal.WritePlan(os.Stdout, plans)
+	return err
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+
+	"port-knocker/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Запустить сервер, принимающий knock последовательности",
+	Long: `Перехватывает входящие пакеты на порты целей из того же конфигурационного файла,
+что использует клиент, отслеживает последовательности для каждого адреса источника и после
+верной последовательности выполняет open_command из блока serve цели (адрес подставляется
+вместо {{.IP}}), а через close_after - close_command. Пакеты читаются сокетом AF_PACKET
+(Linux, нужен root или CAP_NET_RAW), порты последовательности при этом остаются закрытыми.`,
+	RunE: runServe,
+}
+
+var serveListen string
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVarP(&serveListen, "listen", "l", "", "Принимать только пакеты на этот локальный адрес (по умолчанию все адреса)")
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	if configFile == "" {
+		return fmt.Errorf("необходимо указать файл конфигурации (-c)")
+	}
+
+	config, err := internal.NewPortKnocker().LoadConfig(configFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки конфигурации: %w", err)
+	}
+
+	server, err := internal.NewKnockServer(config, serveListen)
+	if err != nil {
+		return err
+	}
+	server.SetVerbose(verbose)
+
+	return server.Serve(cmd.Context())
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"port-knocker/internal"
+
+	"github.com/spf13/cobra"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Проверить конфигурационный файл",
+	Long: `Разбирает конфигурацию (в том числе зашифрованную) в строгом режиме и проверяет
+неизвестные параметры, порты, протоколы, длительности, адреса шлюзов и повторяющиеся имена.
+Все найденные проблемы выводятся с номерами строк YAML.`,
+	Args: cobra.NoArgs,
+	RunE: runValidate,
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+func runValidate(cmd *cobra.Command, args []string) error {
+	if configFile == "" {
+		return fmt.Errorf("необходимо указать файл конфигурации (-c)")
+	}
+
+	knocker := internal.NewPortKnocker()
+	knocker.SetOutput(os.Stderr)
+	config, err := knocker.LoadConfig(configFile, keyFile)
+	if err != nil {
+		cmd.SilenceUsage = true
+		return err
+	}
+
+	fmt.Printf("Конфигурация %s корректна: %d целей\n", configFile, len(config.Targets))
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+// canBindLocal - в Windows dial сам привязывает сокет перед ConnectEx, повторный bind невозможен
+const canBindLocal = false
+
+func bindLocal(fd uintptr, network string, ip net.IP, port int) (net.IP, int, error) {
+	return nil, 0, errors.New("привязка сокета в Control не поддерживается")
+}
@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// canBindLocal - сокет можно привязать к адресу источника в Control до connect
+const canBindLocal = true
+
+// bindLocal привязывает сокет сети network (tcp4, udp6, ...) к ip:port (nil и 0 - любые) и
+// возвращает занятый адрес: порт 0 ядро заменяет эфемерным уже при bind
+func bindLocal(fd uintptr, network string, ip net.IP, port int) (net.IP, int, error) {
+	var sa syscall.Sockaddr
+	if strings.HasSuffix(network, "6") {
+		sa6 := &syscall.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	} else {
+		sa4 := &syscall.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip.To4())
+		sa = sa4
+	}
+	if err := syscall.Bind(int(fd), sa); err != nil {
+		return nil, 0, fmt.Errorf("bind: %w", err)
+	}
+
+	bound, err := syscall.Getsockname(int(fd))
+	if err != nil {
+		return nil, 0, fmt.Errorf("getsockname: %w", err)
+	}
+	switch addr := bound.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(addr.Addr[:]).To16(), addr.Port, nil
+	case *syscall.SockaddrInet6:
+		return net.IP(addr.Addr[:]), addr.Port, nil
+	}
+	return nil, 0, fmt.Errorf("неожиданный адрес сокета %T", bound)
+}
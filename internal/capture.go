@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+)
+
+// TCP флаги, по которым отбираются стуки
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagACK = 0x10
+)
+
+// packetCapture читает IP пакеты, пришедшие на адреса хоста, включая пакеты на закрытые порты
+// и пакеты, которые затем отбросит брандмауэр
+type packetCapture interface {
+	ReadPacket(buf []byte) (int, error)
+	Close() error
+}
+
+// capturedPacket - входящий пакет, который может быть шагом последовательности
+type capturedPacket struct {
+	src      net.IP
+	dst      net.IP
+	protocol string // tcp, udp или icmp
+	port     int    // порт назначения tcp и udp
+	flags    byte   // TCP флаги
+	echo     icmpEcho
+}
+
+// step возвращает шаг последовательности, которым пакет является для цели.
+// Для icmp значение берется из поля echo request, заданного icmp.encode цели
+func (p capturedPacket) step(target Target) sequenceStep {
+	if p.protocol == "icmp" {
+		encoding := target.ICMP.encoding()
+		return sequenceStep{protocol: "icmp", port: p.echo.value(encoding), encoding: encoding}
+	}
+	return sequenceStep{protocol: p.protocol, port: p.port}
+}
+
+// parseCaptured разбирает IPv4 или IPv6 пакет. ok = false для пакетов, которые не могут быть
+// стуком: других протоколов, ICMP кроме echo request и фрагментов кроме первого
+func parseCaptured(data []byte) (packet capturedPacket, ok bool) {
+	if len(data) == 0 {
+		return packet, false
+	}
+
+	var proto byte
+	var payload []byte
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return packet, false
+		}
+		headerLen := int(data[0]&0x0f) * 4
+		if headerLen < 20 || len(data) < headerLen {
+			return packet, false
+		}
+		if binary.BigEndian.Uint16(data[6:])&0x1fff != 0 {
+			return packet, false // продолжение фрагментированного пакета
+		}
+		if total := int(binary.BigEndian.Uint16(data[2:])); total >= headerLen && total < len(data) {
+			data = data[:total] // дополнение кадра до минимальной длины
+		}
+		packet.src, packet.dst = slices.Clone(data[12:16]), slices.Clone(data[16:20])
+		proto, payload = data[9], data[headerLen:]
+	case 6:
+		if len(data) < 40 {
+			return packet, false
+		}
+		packet.src, packet.dst = slices.Clone(data[8:24]), slices.Clone(data[24:40])
+		proto, payload = data[6], data[40:]
+		// Заголовки расширений hop-by-hop, routing и destination options пропускаются
+		for proto == 0 || proto == 43 || proto == 60 {
+			if len(payload) < 8 || len(payload) < (int(payload[1])+1)*8 {
+				return packet, false
+			}
+			proto, payload = payload[0], payload[(int(payload[1])+1)*8:]
+		}
+	default:
+		return packet, false
+	}
+
+	switch proto {
+	case 6:
+		if len(payload) < 20 {
+			return packet, false
+		}
+		packet.protocol = "tcp"
+		packet.port = int(binary.BigEndian.Uint16(payload[2:]))
+		packet.flags = payload[13]
+	case 17:
+		if len(payload) < 8 {
+			return packet, false
+		}
+		packet.protocol = "udp"
+		packet.port = int(binary.BigEndian.Uint16(payload[2:]))
+	case 1, 58:
+		echo, isEcho := parseICMPEcho(payload)
+		if !isEcho {
+			return packet, false
+		}
+		packet.protocol = "icmp"
+		packet.echo = echo
+	default:
+		return packet, false
+	}
+	return packet, true
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// afPacketCapture читает пакеты сокетом AF_PACKET, как pcap: пакеты видны до netfilter, поэтому
+// стук принимается, даже если порт закрыт или пакет отбрасывается правилами INPUT
+type afPacketCapture struct {
+	file *os.File
+	conn syscall.RawConn
+}
+
+// listenCapture открывает сокет захвата входящих пакетов (нужен root или CAP_NET_RAW).
+// ackKnocks - принимать TCP сегменты с ACK (если флаги raw стука их содержат)
+func listenCapture(ackKnocks bool) (packetCapture, error) {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			return nil, fmt.Errorf("не удалось открыть сокет захвата пакетов (нужен root или CAP_NET_RAW): %w", err)
+		}
+		return nil, fmt.Errorf("не удалось открыть сокет захвата пакетов: %w", err)
+	}
+	if err := syscall.AttachLsf(fd, knockFilter(ackKnocks)); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("не удалось установить фильтр пакетов: %w", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "capture")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &afPacketCapture{file: file, conn: conn}, nil
+}
+
+// ReadPacket возвращает следующий пакет, адресованный хосту. Исходящие пакеты и пакеты для
+// других хостов (promiscuous режим, broadcast) пропускаются
+func (c *afPacketCapture) ReadPacket(buf []byte) (int, error) {
+	for {
+		var n int
+		var from syscall.Sockaddr
+		var readErr error
+		err := c.conn.Read(func(fd uintptr) bool {
+			n, from, readErr = syscall.Recvfrom(int(fd), buf, 0)
+			return readErr != syscall.EAGAIN
+		})
+		if err != nil {
+			return 0, err
+		}
+		if readErr != nil {
+			return 0, readErr
+		}
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Pkttype != syscall.PACKET_HOST {
+			continue
+		}
+		return n, nil
+	}
+}
+
+func (c *afPacketCapture) Close() error {
+	return c.file.Close()
+}
+
+// knockFilter - BPF программа, которая оставляет только то, что может быть стуком: первые
+// фрагменты IPv4 и пакеты IPv6 с TCP без ACK, UDP и ICMP. Остальной трафик хоста не копируется
+func knockFilter(ackKnocks bool) []syscall.SockFilter {
+	ackMask := uint32(tcpFlagACK)
+	if ackKnocks {
+		ackMask = 0 // jset #0 никогда не срабатывает: принимаются все TCP сегменты
+	}
+	const (
+		ldAbsB = syscall.BPF_LD | syscall.BPF_B | syscall.BPF_ABS
+		ldAbsH = syscall.BPF_LD | syscall.BPF_H | syscall.BPF_ABS
+		ldIndB = syscall.BPF_LD | syscall.BPF_B | syscall.BPF_IND
+		ldxMsh = syscall.BPF_LDX | syscall.BPF_B | syscall.BPF_MSH
+		rsh    = syscall.BPF_ALU | syscall.BPF_RSH | syscall.BPF_K
+		jeq    = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jset   = syscall.BPF_JMP | syscall.BPF_JSET | syscall.BPF_K
+		ret    = syscall.BPF_RET | syscall.BPF_K
+	)
+	// Переходы относительны: jt/jf - сколько инструкций пропустить
+	return []syscall.SockFilter{
+		/* 0 */ {Code: ldAbsB, K: 0}, // версия IP
+		/* 1 */ {Code: rsh, K: 4},
+		/* 2 */ {Code: jeq, K: 4, Jt: 0, Jf: 9}, // не IPv4 -> 12
+		/* 3 */ {Code: ldAbsH, K: 6}, // смещение фрагмента
+		/* 4 */ {Code: jset, K: 0x1fff, Jt: 17, Jf: 0}, // -> drop
+		/* 5 */ {Code: ldAbsB, K: 9}, // протокол
+		/* 6 */ {Code: jeq, K: 6, Jt: 0, Jf: 3}, // не TCP -> 10
+		/* 7 */ {Code: ldxMsh, K: 0}, // X = длина IPv4 заголовка
+		/* 8 */ {Code: ldIndB, K: 13}, // TCP флаги
+		/* 9 */ {Code: jset, K: ackMask, Jt: 12, Jf: 13}, // ACK -> drop, иначе accept
+		/* 10 */ {Code: jeq, K: 17, Jt: 12, Jf: 0}, // UDP -> accept
+		/* 11 */ {Code: jeq, K: 1, Jt: 11, Jf: 10}, // ICMP -> accept, иначе drop
+		/* 12 */ {Code: jeq, K: 6, Jt: 0, Jf: 9}, // не IPv6 -> drop
+		/* 13 */ {Code: ldAbsB, K: 6}, // next header
+		/* 14 */ {Code: jeq, K: 6, Jt: 0, Jf: 2}, // не TCP -> 17
+		/* 15 */ {Code: ldAbsB, K: 40 + 13}, // TCP флаги
+		/* 16 */ {Code: jset, K: ackMask, Jt: 5, Jf: 6},
+		/* 17 */ {Code: jeq, K: 17, Jt: 5, Jf: 0}, // UDP
+		/* 18 */ {Code: jeq, K: 58, Jt: 4, Jf: 0}, // ICMPv6
+		/* 19 */ {Code: jeq, K: 0, Jt: 3, Jf: 0}, // заголовки расширений разбираются в parseCaptured
+		/* 20 */ {Code: jeq, K: 43, Jt: 2, Jf: 0},
+		/* 21 */ {Code: jeq, K: 60, Jt: 1, Jf: 0},
+		/* 22 */ {Code: ret, K: 0}, // drop
+		/* 23 */ {Code: ret, K: 0xffff}, // accept
+	}
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
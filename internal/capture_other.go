@@ -0,0 +1,10 @@
+//go:build !linux
+
+package internal
+
+import "errors"
+
+// listenCapture на других платформах не поддерживается: нужен сокет AF_PACKET
+func listenCapture(ackKnocks bool) (packetCapture, error) {
+	return nil, errors.New("захват пакетов для serve поддерживается только в Linux")
+}
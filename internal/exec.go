@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"text/template"
+)
+
+// ExecData содержит данные, доступные в шаблонах команды exec: {{.Host}}, {{.Port}} и т.д.
+type ExecData struct {
+	Host     string
+	Protocol string
+	Ports    []int // отправленная последовательность
+	Port     int   // порт из verify (0 если verify не задан)
+}
+
+// NewExecData собирает данные для шаблона по цели и результату knocking
+func NewExecData(target Target, result *TargetResult) ExecData {
+	data := ExecData{Host: target.Host, Protocol: target.DisplayProtocol(), Ports: target.PortNumbers()}
+	if result != nil {
+		data.Ports = result.Ports
+	}
+	if target.Verify != nil {
+		data.Port = target.Verify.Port
+	}
+	return data
+}
+
+// ShellCommand готовит команду exec из конфигурации цели; она выполняется через оболочку
+func ShellCommand(command string, data ExecData) (*exec.Cmd, error) {
+	rendered, err := renderTemplate("exec", command, data)
+	if err != nil {
+		return nil, err
+	}
+	name, args := shellArgs(rendered)
+	return exec.Command(name, args...), nil
+}
+
+// ArgsCommand готовит команду из аргументов командной строки без оболочки;
+// шаблоны подставляются в каждый аргумент отдельно
+func ArgsCommand(argv []string, data ExecData) (*exec.Cmd, error) {
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("не задана команда для выполнения")
+	}
+	rendered := make([]string, len(argv))
+	for i, arg := range argv {
+		value, err := renderTemplate("exec", arg, data)
+		if err != nil {
+			return nil, err
+		}
+		rendered[i] = value
+	}
+	return exec.Command(rendered[0], rendered[1:]...), nil
+}
+
+func renderTemplate(name, text string, data any) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("неверный шаблон %s: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("не удалось подставить данные в %s: %w", name, err)
+	}
+	return buf.String(), nil
+}
+
+// shellArgs возвращает вызов системной оболочки для команды
+func shellArgs(command string) (string, []string) {
+	if runtime.GOOS == "windows" {
+		return "cmd", []string{"/C", command}
+	}
+	return "sh", []string{"-c", command}
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Действия сервера после верной последовательности (serve.action)
+const (
+	ActionExec     = "exec"
+	ActionNftables = "nftables"
+	ActionIptables = "iptables"
+)
+
+// NftablesOptions - элемент добавляется в именованный set с флагом timeout:
+//
+//	nft add set inet filter port_knocker '{ type ipv4_addr; flags timeout; }'
+type NftablesOptions struct {
+	Family string `yaml:"family,omitempty"` // семейство таблицы (по умолчанию inet)
+	Table  string `yaml:"table,omitempty"`  // таблица (по умолчанию filter)
+	Set    string `yaml:"set"`              // set для IPv4 адресов
+	Set6   string `yaml:"set6,omitempty"`   // set для IPv6 адресов (по умолчанию тот же set)
+}
+
+// IptablesOptions - правило вставляется в начало цепочки и удаляется при закрытии
+type IptablesOptions struct {
+	Chain    string `yaml:"chain,omitempty"`    // цепочка (по умолчанию INPUT)
+	Protocol string `yaml:"protocol,omitempty"` // протокол открываемого порта (по умолчанию tcp)
+	Port     int    `yaml:"port"`               // открываемый порт
+	Jump     string `yaml:"jump,omitempty"`     // действие правила (по умолчанию ACCEPT)
+}
+
+// FirewallAction открывает и закрывает доступ для адреса, приславшего верную последовательность
+type FirewallAction interface {
+	// Open открывает доступ; timeout - через сколько доступ будет закрыт (0 - не закрывать)
+	Open(ctx context.Context, data ActionData, timeout time.Duration) error
+	// Close закрывает доступ, открытый Open
+	Close(ctx context.Context, data ActionData) error
+}
+
+// selfExpiringAction реализуют действия, которые закрывают доступ сами по истечении timeout,
+// например элементы nftables set с таймаутом. Для них сервер не планирует Close
+type selfExpiringAction interface {
+	ExpiresItself() bool
+}
+
+// CommandRunner выполняет внешние команды действий
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) error
+}
+
+// ExecRunner выполняет команды как процессы
+type ExecRunner struct{}
+
+// Run запускает команду и возвращает ошибку вместе с ее выводом
+func (ExecRunner) Run(ctx context.Context, name string, args ...string) error {
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if message := strings.TrimSpace(string(output)); message != "" {
+		return fmt.Errorf("%s: %w: %s", name, err, message)
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+// RecordingRunner ничего не запускает, а только запоминает команды, которые были бы выполнены.
+// Позволяет проверять правила nftables/iptables без прав root
+type RecordingRunner struct {
+	mu       sync.Mutex
+	commands [][]string
+}
+
+// Run записывает команду
+func (r *RecordingRunner) Run(ctx context.Context, name string, args ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, append([]string{name}, args...))
+	return nil
+}
+
+// Commands возвращает записанные команды в порядке выполнения
+func (r *RecordingRunner) Commands() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]string(nil), r.commands...)
+}
+
+// NewFirewallAction создает действие по блоку serve цели
+func NewFirewallAction(opts *ServeOptions, runner CommandRunner) (FirewallAction, error) {
+	switch opts.actionName() {
+	case ActionExec:
+		return newExecAction(opts.OpenCommand, opts.CloseCommand, runner)
+	case ActionNftables:
+		if opts.Nftables == nil || opts.Nftables.Set == "" {
+			return nil, fmt.Errorf("для action: nftables требуется nftables.set")
+		}
+		return &nftablesAction{opts: *opts.Nftables, runner: runner}, nil
+	case ActionIptables:
+		if opts.Iptables == nil || opts.Iptables.Port < 1 || opts.Iptables.Port > 65535 {
+			return nil, fmt.Errorf("для action: iptables требуется iptables.port (1-65535)")
+		}
+		return &iptablesAction{opts: *opts.Iptables, runner: runner}, nil
+	default:
+		return nil, fmt.Errorf("неизвестное действие сервера: %s", opts.Action)
+	}
+}
+
+// execAction выполняет произвольные команды оболочки с подстановкой {{.IP}} и других полей ActionData
+type execAction struct {
+	open   *template.Template
+	close  *template.Template
+	runner CommandRunner
+}
+
+func newExecAction(openCommand, closeCommand string, runner CommandRunner) (*execAction, error) {
+	a := &execAction{runner: runner}
+	var err error
+	if openCommand != "" {
+		if a.open, err = template.New("open_command").Parse(openCommand); err != nil {
+			return nil, fmt.Errorf("неверный шаблон open_command: %w", err)
+		}
+	}
+	if closeCommand != "" {
+		if a.close, err = template.New("close_command").Parse(closeCommand); err != nil {
+			return nil, fmt.Errorf("неверный шаблон close_command: %w", err)
+		}
+	}
+	return a, nil
+}
+
+func (a *execAction) Open(ctx context.Context, data ActionData, timeout time.Duration) error {
+	return a.run(ctx, a.open, data)
+}
+
+func (a *execAction) Close(ctx context.Context, data ActionData) error {
+	return a.run(ctx, a.close, data)
+}
+
+func (a *execAction) run(ctx context.Context, tmpl *template.Template, data ActionData) error {
+	if tmpl == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return fmt.Errorf("не удалось подставить данные в команду: %w", err)
+	}
+	name, args := shellArgs(buf.String())
+	return a.runner.Run(ctx, name, args...)
+}
+
+// nftablesAction добавляет адрес в set с таймаутом, поэтому доступ закрывается ядром,
+// даже если сервер был остановлен
+type nftablesAction struct {
+	opts   NftablesOptions
+	runner CommandRunner
+}
+
+func (a *nftablesAction) ExpiresItself() bool { return true }
+
+// Open добавляет адрес в set. add element не обновляет таймаут существующего элемента, поэтому
+// при повторной последовательности элемент пересоздается: add, delete и add с таймаутом выполняются
+// одной транзакцией nft, и доступ продлевается так же, как для iptables и exec
+func (a *nftablesAction) Open(ctx context.Context, data ActionData, timeout time.Duration) error {
+	if timeout <= 0 {
+		return a.runner.Run(ctx, "nft", a.command("add", data.IP, data.IP)...)
+	}
+
+	args := a.command("add", data.IP, data.IP)
+	args = append(args, ";")
+	args = append(args, a.command("delete", data.IP, data.IP)...)
+	args = append(args, ";")
+	args = append(args, a.command("add", data.IP, data.IP+" timeout "+nftDuration(timeout))...)
+	return a.runner.Run(ctx, "nft", args...)
+}
+
+func (a *nftablesAction) Close(ctx context.Context, data ActionData) error {
+	return a.runner.Run(ctx, "nft", a.command("delete", data.IP, data.IP)...)
+}
+
+// command возвращает аргументы nft для операции op над элементом set адреса ip
+func (a *nftablesAction) command(op, ip, element string) []string {
+	return []string{op, "element", a.family(), a.table(), a.set(ip), "{ " + element + " }"}
+}
+
+func (a *nftablesAction) family() string {
+	if a.opts.Family == "" {
+		return "inet"
+	}
+	return a.opts.Family
+}
+
+func (a *nftablesAction) table() string {
+	if a.opts.Table == "" {
+		return "filter"
+	}
+	return a.opts.Table
+}
+
+func (a *nftablesAction) set(ip string) string {
+	if a.opts.Set6 != "" && isIPv6(ip) {
+		return a.opts.Set6
+	}
+	return a.opts.Set
+}
+
+// nftDuration записывает длительность для nft в секундах, округляя вверх
+func nftDuration(d time.Duration) string {
+	seconds := int64((d + time.Second - 1) / time.Second)
+	return strconv.FormatInt(seconds, 10) + "s"
+}
+
+// iptablesAction вставляет разрешающее правило для адреса и удаляет его при закрытии.
+// Для IPv6 адресов используется ip6tables
+type iptablesAction struct {
+	opts   IptablesOptions
+	runner CommandRunner
+}
+
+func (a *iptablesAction) Open(ctx context.Context, data ActionData, timeout time.Duration) error {
+	return a.runner.Run(ctx, a.command(data.IP), a.rule("-I", data.IP)...)
+}
+
+func (a *iptablesAction) Close(ctx context.Context, data ActionData) error {
+	return a.runner.Run(ctx, a.command(data.IP), a.rule("-D", data.IP)...)
+}
+
+func (a *iptablesAction) command(ip string) string {
+	if isIPv6(ip) {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (a *iptablesAction) rule(op, ip string) []string {
+	chain, protocol, jump := a.opts.Chain, a.opts.Protocol, a.opts.Jump
+	if chain == "" {
+		chain = "INPUT"
+	}
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	if jump == "" {
+		jump = "ACCEPT"
+	}
+	return []string{op, chain, "-s", ip, "-p", protocol, "--dport", strconv.Itoa(a.opts.Port), "-j", jump}
+}
+
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
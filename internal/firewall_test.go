@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFirewallActionCommands(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  ServeOptions
+		ip    string
+		open  string
+		close string
+	}{
+		{
+			name: "exec",
+			opts: ServeOptions{
+				OpenCommand:  "iptables -I INPUT -s {{.IP}} -p tcp --dport 22 -j ACCEPT",
+				CloseCommand: "iptables -D INPUT -s {{.IP}} -p tcp --dport 22 -j ACCEPT",
+			},
+			ip:    "192.0.2.1",
+			open:  "iptables -I INPUT -s 192.0.2.1 -p tcp --dport 22 -j ACCEPT",
+			close: "iptables -D INPUT -s 192.0.2.1 -p tcp --dport 22 -j ACCEPT",
+		},
+		{
+			name:  "nftables",
+			opts:  ServeOptions{Action: ActionNftables, Nftables: &NftablesOptions{Set: "knock", Set6: "knock6"}},
+			ip:    "192.0.2.1",
+			open:  "nft add element inet filter knock { 192.0.2.1 } ; delete element inet filter knock { 192.0.2.1 } ; add element inet filter knock { 192.0.2.1 timeout 30s }",
+			close: "nft delete element inet filter knock { 192.0.2.1 }",
+		},
+		{
+			name:  "nftables IPv6",
+			opts:  ServeOptions{Action: ActionNftables, Nftables: &NftablesOptions{Family: "ip6", Table: "fw", Set: "knock", Set6: "knock6"}},
+			ip:    "2001:db8::1",
+			open:  "nft add element ip6 fw knock6 { 2001:db8::1 } ; delete element ip6 fw knock6 { 2001:db8::1 } ; add element ip6 fw knock6 { 2001:db8::1 timeout 30s }",
+			close: "nft delete element ip6 fw knock6 { 2001:db8::1 }",
+		},
+		{
+			name:  "iptables",
+			opts:  ServeOptions{Action: ActionIptables, Iptables: &IptablesOptions{Port: 22}},
+			ip:    "192.0.2.1",
+			open:  "iptables -I INPUT -s 192.0.2.1 -p tcp --dport 22 -j ACCEPT",
+			close: "iptables -D INPUT -s 192.0.2.1 -p tcp --dport 22 -j ACCEPT",
+		},
+		{
+			name:  "ip6tables",
+			opts:  ServeOptions{Action: ActionIptables, Iptables: &IptablesOptions{Chain: "KNOCK", Protocol: "udp", Port: 51820, Jump: "RETURN"}},
+			ip:    "2001:db8::1",
+			open:  "ip6tables -I KNOCK -s 2001:db8::1 -p udp --dport 51820 -j RETURN",
+			close: "ip6tables -D KNOCK -s 2001:db8::1 -p udp --dport 51820 -j RETURN",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &RecordingRunner{}
+			action, err := NewFirewallAction(&tt.opts, runner)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := ActionData{IP: tt.ip, Host: "server.example.com", Protocol: "tcp", Ports: []int{7000}}
+			if err := action.Open(context.Background(), data, 30*time.Second); err != nil {
+				t.Fatal(err)
+			}
+			if err := action.Close(context.Background(), data); err != nil {
+				t.Fatal(err)
+			}
+
+			want := []string{tt.open, tt.close}
+			if got := commandLines(runner.Commands()); !slices.Equal(got, want) {
+				t.Errorf("команды:\n%s\nожидается:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestServerReknock(t *testing.T) {
+	const closeAfter = 30 * time.Second
+
+	tests := []struct {
+		name   string
+		opts   ServeOptions
+		timers int      // запланированных закрытий после трех последовательностей
+		want   []string // команды после трех последовательностей и истечения close_after
+	}{
+		{
+			name:   "exec",
+			opts:   ServeOptions{OpenCommand: "open {{.IP}}", CloseCommand: "close {{.IP}}"},
+			timers: 1,
+			want:   []string{"open 192.0.2.1", "close 192.0.2.1"},
+		},
+		{
+			name:   "iptables",
+			opts:   ServeOptions{Action: ActionIptables, Iptables: &IptablesOptions{Port: 22}},
+			timers: 1,
+			want: []string{
+				"iptables -I INPUT -s 192.0.2.1 -p tcp --dport 22 -j ACCEPT",
+				"iptables -D INPUT -s 192.0.2.1 -p tcp --dport 22 -j ACCEPT",
+			},
+		},
+		{
+			// Элемент с таймаутом закрывает ядро: каждая последовательность пересоздает его с новым таймаутом
+			name: "nftables",
+			opts: ServeOptions{Action: ActionNftables, Nftables: &NftablesOptions{Set: "knock"}},
+			want: []string{
+				"nft add element inet filter knock { 192.0.2.1 } ; delete element inet filter knock { 192.0.2.1 } ; add element inet filter knock { 192.0.2.1 timeout 30s }",
+				"nft add element inet filter knock { 192.0.2.1 } ; delete element inet filter knock { 192.0.2.1 } ; add element inet filter knock { 192.0.2.1 timeout 30s }",
+				"nft add element inet filter knock { 192.0.2.1 } ; delete element inet filter knock { 192.0.2.1 } ; add element inet filter knock { 192.0.2.1 timeout 30s }",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.CloseAfter = Duration(closeAfter)
+			config := &Config{Targets: []Target{{Host: "server.example.com", Ports: portSpecs([]int{7000}), Protocol: "tcp", Serve: &opts}}}
+			server, err := NewKnockServer(config, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server.SetOutput(io.Discard)
+			runner := &RecordingRunner{}
+			server.SetCommandRunner(runner)
+			timers := &manualTimers{}
+			server.afterFunc = timers.afterFunc
+
+			for i := 0; i < 3; i++ {
+				server.accept(context.Background(), 0, "192.0.2.1")
+			}
+			if n := timers.pending(closeAfter); n != tt.timers {
+				t.Fatalf("запланировано закрытий %d, ожидается %d", n, tt.timers)
+			}
+			timers.fire()
+			if n := len(server.closers); n != 0 {
+				t.Errorf("после закрытия осталось %d запланированных закрытий", n)
+			}
+
+			got := commandLines(runner.Commands())
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("команды:\n%s\nожидается:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// manualTimers заменяет time.AfterFunc сервера: таймеры срабатывают только по вызову fire
+type manualTimers struct {
+	mu     sync.Mutex
+	timers []*manualTimer
+}
+
+type manualTimer struct {
+	owner *manualTimers
+	d     time.Duration
+	f     func()
+	done  bool // остановлен или уже сработал
+}
+
+func (m *manualTimers) afterFunc(d time.Duration, f func()) closeTimer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	timer := &manualTimer{owner: m, d: d, f: f}
+	m.timers = append(m.timers, timer)
+	return timer
+}
+
+func (t *manualTimer) Stop() bool {
+	t.owner.mu.Lock()
+	defer t.owner.mu.Unlock()
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
+// pending возвращает количество активных таймеров на d
+func (m *manualTimers) pending(d time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, timer := range m.timers {
+		if !timer.done && timer.d == d {
+			n++
+		}
+	}
+	return n
+}
+
+// fire выполняет все активные таймеры, как будто их время истекло
+func (m *manualTimers) fire() {
+	m.mu.Lock()
+	var due []func()
+	for _, timer := range m.timers {
+		if !timer.done {
+			timer.done = true
+			due = append(due, timer.f)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, f := range due {
+		f()
+	}
+}
+
+// commandLines склеивает записанные команды в строки; для exec берется сама команда оболочки
+func commandLines(commands [][]string) []string {
+	var lines []string
+	for _, command := range commands {
+		if command[0] == "sh" || command[0] == "cmd" {
+			command = command[2:]
+		}
+		lines = append(lines, strings.Join(command, " "))
+	}
+	return lines
+}
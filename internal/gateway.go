@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// defaultGatewayTTL - TTL пакетов, отправляемых через шлюз без блока raw
+const defaultGatewayTTL = 64
+
+// sendViaGateway собирает IP пакет шага и отправляет его кадром на адрес шлюза в его сети, минуя
+// таблицу маршрутизации: следующим узлом становится именно шлюз. TCP шаг уходит одним сегментом,
+// как raw стук (флаги и TTL берутся из блока raw, если он задан)
+func sendViaGateway(ctx context.Context, packet knockPacket, result *PacketResult) error {
+	remote, err := net.DefaultResolver.LookupIPAddr(ctx, packet.Host)
+	if err != nil {
+		return err
+	}
+	dst, src, gateway := remote[0].IP, packet.Source.IP, packet.Source.Gateway
+	v6 := dst.To4() == nil
+	if v6 != (src.To4() == nil) || v6 != (gateway.To4() == nil) {
+		return fmt.Errorf("шлюз %s и адрес %s разных версий IP", gateway, dst)
+	}
+	if !v6 {
+		dst, src = dst.To4(), src.To4()
+	}
+
+	srcPort := packet.Source.Port
+	if srcPort == 0 {
+		srcPort = ephemeralPort()
+	}
+	result.LocalAddr = net.JoinHostPort(src.String(), strconv.Itoa(srcPort))
+	result.RemoteAddr = net.JoinHostPort(dst.String(), strconv.Itoa(packet.Port))
+
+	ttl := defaultGatewayTTL
+	var proto byte
+	var segment []byte
+	switch packet.Protocol {
+	case "tcp":
+		flags := byte(tcpFlagSYN)
+		if packet.Raw != nil {
+			if flags, err = packet.Raw.tcpFlags(); err != nil {
+				return err
+			}
+			ttl = packet.Raw.ttl()
+		}
+		proto, segment = 6, tcpSegment(src, dst, srcPort, packet.Port, flags, packet.Payload)
+		result.PayloadSize = len(packet.Payload)
+		result.Raw = true
+	case "udp":
+		proto, segment = 17, udpDatagram(src, dst, srcPort, packet.Port, packet.Payload)
+		result.PayloadSize = len(packet.Payload)
+	case "icmp":
+		echo := newICMPEcho(packet.ICMP.encoding(), packet.Port, packet.Payload)
+		proto, segment = 1, echo.marshal(v6)
+		if v6 {
+			proto = 58
+			binary.BigEndian.PutUint16(segment[2:], transportChecksum(src, dst, proto, segment))
+		}
+		result.LocalAddr, result.RemoteAddr = src.String(), dst.String()
+		result.PayloadSize = len(echo.Data)
+	default:
+		return fmt.Errorf("неподдерживаемый протокол: %s", packet.Protocol)
+	}
+
+	return writeGateway(packet.Source.Interface, gateway, ipPacket(src, dst, proto, ttl, segment))
+}
+
+// udpDatagram собирает UDP заголовок с payload и контрольной суммой
+func udpDatagram(src, dst net.IP, srcPort, dstPort int, payload []byte) []byte {
+	datagram := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(datagram[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(datagram[2:], uint16(dstPort))
+	binary.BigEndian.PutUint16(datagram[4:], uint16(len(datagram)))
+	copy(datagram[8:], payload)
+
+	checksum := transportChecksum(src, dst, 17, datagram)
+	if checksum == 0 {
+		checksum = 0xffff // ноль в UDP означает "без контрольной суммы"
+	}
+	binary.BigEndian.PutUint16(datagram[6:], checksum)
+	return datagram
+}
+
+// ipPacket добавляет к сегменту заголовок IPv4 (без опций, с DF) или IPv6
+func ipPacket(src, dst net.IP, proto byte, ttl int, segment []byte) []byte {
+	if src.To4() == nil {
+		packet := make([]byte, 40+len(segment))
+		packet[0] = 6 << 4
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(segment)))
+		packet[6] = proto
+		packet[7] = byte(ttl)
+		copy(packet[8:], src.To16())
+		copy(packet[24:], dst.To16())
+		copy(packet[40:], segment)
+		return packet
+	}
+
+	packet := make([]byte, 20+len(segment))
+	packet[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:], uint16(randomUint32())) // identification
+	binary.BigEndian.PutUint16(packet[6:], 0x4000)                 // DF
+	packet[8] = byte(ttl)
+	packet[9] = proto
+	copy(packet[12:], src.To4())
+	copy(packet[16:], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:], internetChecksum(packet[:20]))
+	copy(packet[20:], segment)
+	return packet
+}
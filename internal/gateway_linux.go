@@ -0,0 +1,143 @@
+//go:build linux
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// neighborTimeout - сколько ждать, пока ядро определит адрес канального уровня шлюза
+const neighborTimeout = time.Second
+
+// Атрибуты и состояния записей таблицы соседей (linux/neighbour.h)
+const (
+	ndaDst        = 1
+	ndaLLAddr     = 2
+	nudIncomplete = 0x01
+	nudFailed     = 0x20
+)
+
+// writeGateway отправляет готовый IP пакет с интерфейса device кадром на адрес канального уровня
+// шлюза сокетом AF_PACKET (нужен root или CAP_NET_RAW). У интерфейсов без адресов канального
+// уровня (loopback, tun) пакет уходит в интерфейс как есть
+func writeGateway(device string, gateway net.IP, packet []byte) error {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return fmt.Errorf("интерфейс %s не найден: %w", device, err)
+	}
+
+	protocol := uint16(syscall.ETH_P_IP)
+	if packet[0]>>4 == 6 {
+		protocol = syscall.ETH_P_IPV6
+	}
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(protocol), Ifindex: iface.Index}
+	if len(iface.HardwareAddr) > 0 && iface.Flags&net.FlagLoopback == 0 {
+		mac, err := resolveNeighbor(iface, gateway)
+		if err != nil {
+			return err
+		}
+		addr.Halen = uint8(copy(addr.Addr[:], mac))
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			return fmt.Errorf("для отправки через шлюз нужен root или CAP_NET_RAW: %w", err)
+		}
+		return fmt.Errorf("не удалось открыть сокет AF_PACKET: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Sendto(fd, packet, 0, addr); err != nil {
+		return fmt.Errorf("не удалось отправить пакет через шлюз %s: %w", gateway, err)
+	}
+	return nil
+}
+
+// resolveNeighbor возвращает адрес канального уровня шлюза из таблицы соседей. Если записи нет,
+// ядро определяет адрес (ARP или NDP) после пустой датаграммы на порт discard шлюза
+func resolveNeighbor(iface *net.Interface, gateway net.IP) (net.HardwareAddr, error) {
+	mac, err := lookupNeighbor(iface.Index, gateway)
+	if err != nil || mac != nil {
+		return mac, err
+	}
+
+	dialer := sourceBinding{Interface: iface.Name}.dialer("udp", 0)
+	if conn, err := dialer.Dial("udp", net.JoinHostPort(gateway.String(), "9")); err == nil {
+		conn.Write(nil)
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(neighborTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		if mac, err = lookupNeighbor(iface.Index, gateway); err != nil || mac != nil {
+			return mac, err
+		}
+	}
+	return nil, fmt.Errorf("не удалось определить адрес канального уровня шлюза %s на %s", gateway, iface.Name)
+}
+
+// lookupNeighbor ищет шлюз в таблице соседей интерфейса ifindex (nil - записи нет или она неполная)
+func lookupNeighbor(ifindex int, gateway net.IP) (net.HardwareAddr, error) {
+	family, ip := syscall.AF_INET6, gateway.To16()
+	if ip4 := gateway.To4(); ip4 != nil {
+		family, ip = syscall.AF_INET, ip4
+	}
+
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, family)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать таблицу соседей: %w", err)
+	}
+	return parseNeighbors(rib, ifindex, ip)
+}
+
+// parseNeighbors ищет адрес ip интерфейса ifindex в ответе RTM_GETNEIGH. Записи в состоянии
+// INCOMPLETE и FAILED пропускаются: адреса канального уровня у них нет
+func parseNeighbors(rib []byte, ifindex int, ip net.IP) (net.HardwareAddr, error) {
+	messages, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось разобрать таблицу соседей: %w", err)
+	}
+
+	for _, m := range messages {
+		// ndmsg: family, pad, pad, ifindex (4 байта), state (2), flags, type
+		if m.Header.Type != syscall.RTM_NEWNEIGH || len(m.Data) < 12 {
+			continue
+		}
+		index := int(int32(binary.NativeEndian.Uint32(m.Data[4:])))
+		state := binary.NativeEndian.Uint16(m.Data[8:])
+		if index != ifindex || state&(nudIncomplete|nudFailed) != 0 {
+			continue
+		}
+
+		var dst, lladdr []byte
+		for attrs := m.Data[12:]; len(attrs) >= 4; {
+			length := int(binary.NativeEndian.Uint16(attrs[0:]))
+			if length < 4 || length > len(attrs) {
+				break
+			}
+			switch binary.NativeEndian.Uint16(attrs[2:]) {
+			case ndaDst:
+				dst = attrs[4:length]
+			case ndaLLAddr:
+				lladdr = attrs[4:length]
+			}
+			aligned := (length + 3) &^ 3
+			if aligned > len(attrs) {
+				break
+			}
+			attrs = attrs[aligned:]
+		}
+		if bytes.Equal(dst, ip) && len(lladdr) > 0 {
+			return net.HardwareAddr(lladdr), nil
+		}
+	}
+	return nil, nil
+}
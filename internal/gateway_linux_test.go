@@ -0,0 +1,74 @@
+//go:build linux
+
+package internal
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// neighborDump - ответ ядра на RTM_GETNEIGH (AF_INET, little-endian), снятый на хосте с eth0
+// (ifindex 4): 192.0.2.77 FAILED, 192.0.2.1 STALE с адресом 02:fc:00:00:00:05, запись lo
+// (ifindex 1) NOARP и завершающий NLMSG_DONE
+const neighborDump = "" +
+	"400000001c000200010000009731000002000000040000002000000108000100c000024d080004000600000014000300" +
+	"233a0100b322010082210100000000004c0000001c000200010000009731000002000000040000000400000108000100" +
+	"c00002010a00020002fc0000000500000800040001000000140003008b1200008b120000f2000000000000004c000000" +
+	"1c000200010000009731000002000000010000004000000308000100000000000a000200000000000000000008000400" +
+	"000000001400030017000000506a0800506a0800000000001400000003000200010000009731000000000000"
+
+// Смещения полей state записей 192.0.2.77 и 192.0.2.1: заголовок nlmsghdr (16) + 8 байт ndmsg
+const (
+	failedStateOffset = 16 + 8
+	staleStateOffset  = 64 + 16 + 8
+)
+
+func TestParseNeighbors(t *testing.T) {
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("ответ снят на little-endian хосте")
+	}
+	dump, err := hex.DecodeString(neighborDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withState := func(offset int, state uint16) []byte {
+		patched := append([]byte(nil), dump...)
+		binary.NativeEndian.PutUint16(patched[offset:], state)
+		return patched
+	}
+
+	tests := []struct {
+		name    string
+		rib     []byte
+		ifindex int
+		ip      string
+		want    string // пусто - адрес не найден
+	}{
+		{name: "STALE запись", rib: dump, ifindex: 4, ip: "192.0.2.1", want: "02:fc:00:00:00:05"},
+		{name: "другой интерфейс", rib: dump, ifindex: 2, ip: "192.0.2.1"},
+		{name: "нет записи", rib: dump, ifindex: 4, ip: "192.0.2.2"},
+		{name: "FAILED", rib: dump, ifindex: 4, ip: "192.0.2.77"},
+		{name: "REACHABLE", rib: withState(staleStateOffset, 0x02), ifindex: 4, ip: "192.0.2.1", want: "02:fc:00:00:00:05"},
+		{name: "INCOMPLETE", rib: withState(staleStateOffset, nudIncomplete), ifindex: 4, ip: "192.0.2.1"},
+		{name: "FAILED с адресом", rib: withState(staleStateOffset, nudFailed), ifindex: 4, ip: "192.0.2.1"},
+		{name: "REACHABLE без адреса канального уровня", rib: withState(failedStateOffset, 0x02), ifindex: 4, ip: "192.0.2.77"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, err := parseNeighbors(tt.rib, tt.ifindex, net.ParseIP(tt.ip).To4())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := mac.String(); got != tt.want {
+				t.Errorf("адрес %q, ожидается %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseNeighbors(dump[:40], 4, net.ParseIP("192.0.2.1").To4()); err == nil {
+		t.Error("обрезанный ответ разобран без ошибки")
+	}
+}
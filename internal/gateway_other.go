@@ -0,0 +1,13 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+// writeGateway на других платформах не поддерживается: нужен сокет AF_PACKET
+func writeGateway(device string, gateway net.IP, packet []byte) error {
+	return errors.New("отправка через шлюз поддерживается только в Linux")
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestIPPacket(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.IP
+	}{
+		{name: "IPv4", src: net.ParseIP("192.0.2.1").To4(), dst: net.ParseIP("198.51.100.7").To4()},
+		{name: "IPv6", src: net.ParseIP("2001:db8::1"), dst: net.ParseIP("2001:db8::2")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datagram := udpDatagram(tt.src, tt.dst, 40000, 7000, []byte("knock"))
+			if got := binary.BigEndian.Uint16(datagram[4:]); got != 13 {
+				t.Errorf("длина датаграммы %d, ожидается 13", got)
+			}
+			if sum := transportChecksum(tt.src, tt.dst, 17, datagram); sum != 0 {
+				t.Errorf("контрольная сумма UDP неверна: остаток %#04x", sum)
+			}
+
+			packet := ipPacket(tt.src, tt.dst, 17, 33, datagram)
+			parsed, ok := parseCaptured(packet)
+			if !ok {
+				t.Fatal("пакет не разобран")
+			}
+			if !parsed.src.Equal(tt.src) || !parsed.dst.Equal(tt.dst) || parsed.protocol != "udp" || parsed.port != 7000 {
+				t.Errorf("разобрано %s/%d от %s к %s", parsed.protocol, parsed.port, parsed.src, parsed.dst)
+			}
+
+			if tt.src.To4() != nil {
+				if len(packet) != 20+len(datagram) || packet[8] != 33 || packet[9] != 17 {
+					t.Errorf("заголовок IPv4 % x", packet[:20])
+				}
+				if sum := internetChecksum(packet[:20]); sum != 0 {
+					t.Errorf("контрольная сумма IPv4 неверна: остаток %#04x", sum)
+				}
+				return
+			}
+			if len(packet) != 40+len(datagram) || packet[6] != 17 || packet[7] != 33 {
+				t.Errorf("заголовок IPv6 % x", packet[:40])
+			}
+		})
+	}
+}
+
+// TestGatewayLoopback отправляет шаги через шлюз 127.0.0.9 в сети lo и ловит их захватом сервера
+// (нужен root). Сокету пакет не доставляется: пришедший снаружи пакет с адресом 127.0.0.0/8 ядро
+// отбрасывает при маршрутизации, если не включен route_localnet
+func TestGatewayLoopback(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("нужен Linux и root")
+	}
+
+	tests := []struct {
+		protocol string
+		port     int
+	}{
+		{protocol: "udp", port: 17001},
+		{protocol: "tcp", port: 17002},
+		{protocol: "icmp", port: 17003},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			capture, err := listenCapture(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer capture.Close()
+
+			target := Target{
+				Host:       "127.0.0.1",
+				Ports:      portSpecs([]int{tt.port}),
+				Protocol:   tt.protocol,
+				Gateway:    "127.0.0.9",
+				SourcePort: 40000,
+			}
+			result := knockLoopback(t, target)
+			if len(result.Packets) != 1 || result.Packets[0].Outcome != OutcomeSent {
+				t.Fatalf("пакеты %+v, ожидается один отправленный", result.Packets)
+			}
+
+			go func() {
+				time.Sleep(2 * time.Second)
+				capture.Close()
+			}()
+			buf := make([]byte, 65536)
+			for {
+				n, err := capture.ReadPacket(buf)
+				if err != nil {
+					t.Fatalf("пакет не захвачен: %v", err)
+				}
+				packet, ok := parseCaptured(buf[:n])
+				if !ok || packet.protocol != tt.protocol || packet.step(target).port != tt.port {
+					continue
+				}
+				if !packet.src.Equal(net.ParseIP("127.0.0.1")) {
+					t.Errorf("пакет от %s, ожидается 127.0.0.1", packet.src)
+				}
+				if tt.protocol == "tcp" && packet.flags != tcpFlagSYN {
+					t.Errorf("флаги %#x, ожидается SYN", packet.flags)
+				}
+				return
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	ICMPEncodeSeq  = "seq"  // значение шага - sequence number echo request
+	ICMPEncodeID   = "id"   // значение шага - identifier echo request
+	ICMPEncodeSize = "size" // значение шага - размер данных echo request
+
+	maxICMPSize = 65507 // наибольший размер данных echo request в IPv4 пакете
+)
+
+// errPingUnavailable означает, что непривилегированные ping сокеты не поддерживаются платформой
+var errPingUnavailable = errors.New("ping сокеты не поддерживаются")
+
+// ICMPOptions задает, в каком поле echo request передается значение шага ICMP knock
+type ICMPOptions struct {
+	Encode string `yaml:"encode,omitempty"` // seq (по умолчанию), id или size
+}
+
+func (o *ICMPOptions) encoding() string {
+	if o == nil || o.Encode == "" {
+		return ICMPEncodeSeq
+	}
+	return strings.ToLower(o.Encode)
+}
+
+func (o *ICMPOptions) validate() error {
+	switch o.encoding() {
+	case ICMPEncodeSeq, ICMPEncodeID, ICMPEncodeSize:
+		return nil
+	default:
+		return fmt.Errorf("неизвестный способ кодирования '%s', ожидается seq, id или size", o.Encode)
+	}
+}
+
+// icmpEcho - поля echo request, в которые кодируется шаг
+type icmpEcho struct {
+	ID   int
+	Seq  int
+	Data []byte
+}
+
+// newICMPEcho кодирует значение шага в echo request; остальные поля заполняются как у обычного ping
+func newICMPEcho(encoding string, value int, payload []byte) icmpEcho {
+	echo := icmpEcho{ID: int(randomUint32() & 0xffff), Seq: 1, Data: payload}
+	switch encoding {
+	case ICMPEncodeID:
+		echo.ID = value
+	case ICMPEncodeSize:
+		echo.Data = make([]byte, value)
+	default:
+		echo.Seq = value
+	}
+	return echo
+}
+
+// value возвращает значение шага, закодированное в echo request
+func (e icmpEcho) value(encoding string) int {
+	switch encoding {
+	case ICMPEncodeID:
+		return e.ID
+	case ICMPEncodeSize:
+		return len(e.Data)
+	default:
+		return e.Seq
+	}
+}
+
+// marshal собирает сообщение echo request. Контрольную сумму ICMPv6 считает ядро
+func (e icmpEcho) marshal(v6 bool) []byte {
+	message := make([]byte, 8+len(e.Data))
+	message[0] = 8 // echo request
+	if v6 {
+		message[0] = 128
+	}
+	binary.BigEndian.PutUint16(message[4:], uint16(e.ID))
+	binary.BigEndian.PutUint16(message[6:], uint16(e.Seq))
+	copy(message[8:], e.Data)
+	if !v6 {
+		binary.BigEndian.PutUint16(message[2:], internetChecksum(message))
+	}
+	return message
+}
+
+// parseICMPEcho разбирает ICMP сообщение без IP заголовка; ok - это echo request
+func parseICMPEcho(message []byte) (echo icmpEcho, ok bool) {
+	if len(message) < 8 || (message[0] != 8 && message[0] != 128) || message[1] != 0 {
+		return icmpEcho{}, false
+	}
+	return icmpEcho{
+		ID:   int(binary.BigEndian.Uint16(message[4:])),
+		Seq:  int(binary.BigEndian.Uint16(message[6:])),
+		Data: message[8:],
+	}, true
+}
+
+// sendICMP отправляет один echo request со значением шага. Ответ не ожидается:
+// как и для UDP, факт отправки - это и есть стук
+func sendICMP(ctx context.Context, packet knockPacket, result *PacketResult) error {
+	remote, err := net.DefaultResolver.LookupIPAddr(ctx, packet.Host)
+	if err != nil {
+		return err
+	}
+	dst := remote[0].IP
+	v6 := dst.To4() == nil
+	if !v6 {
+		dst = dst.To4()
+	}
+
+	src, err := sourceIP(ctx, dst, packet.Source)
+	if err != nil {
+		return err
+	}
+
+	encoding := packet.ICMP.encoding()
+	echo := newICMPEcho(encoding, packet.Port, packet.Payload)
+
+	bindID := 0
+	if encoding == ICMPEncodeID {
+		bindID = echo.ID
+	}
+	conn, ping, err := listenICMP(v6, src, bindID, packet.Source.Interface)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(packet.Timeout))
+
+	var addr net.Addr = &net.IPAddr{IP: dst}
+	if ping {
+		addr = &net.UDPAddr{IP: dst}
+	}
+	result.LocalAddr = src.String()
+	result.RemoteAddr = dst.String()
+
+	if _, err := conn.WriteTo(echo.marshal(v6), addr); err != nil {
+		return fmt.Errorf("не удалось отправить echo request: %w", err)
+	}
+	result.PayloadSize = len(echo.Data)
+	return nil
+}
+
+// listenICMP открывает сокет для отправки echo request: ping сокет, если система разрешает его
+// пользователю (net.ipv4.ping_group_range), иначе raw сокет (нужен root или CAP_NET_RAW).
+// id задает identifier для ping сокета, у которого его выбирает ядро (0 - любой)
+func listenICMP(v6 bool, src net.IP, id int, device string) (conn net.PacketConn, ping bool, err error) {
+	conn, err = listenPing(v6, src, id, device)
+	if err == nil {
+		return conn, true, nil
+	}
+
+	network := "ip4:icmp"
+	if v6 {
+		network = "ip6:ipv6-icmp"
+	}
+	conn, rawErr := net.ListenPacket(network, src.String())
+	if rawErr != nil {
+		return nil, false, fmt.Errorf("нет доступа к ICMP сокетам (ping сокет: %v; raw сокет: %v)", err, rawErr)
+	}
+	rawConn, err := conn.(*net.IPConn).SyscallConn()
+	if err == nil {
+		err = bindDevice(rawConn, device)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	return conn, false, nil
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package internal
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenPing открывает непривилегированный ping сокет (SOCK_DGRAM, IPPROTO_ICMP). Identifier
+// echo request ядро берет из локального порта сокета, поэтому id задается через bind
+func listenPing(v6 bool, src net.IP, id int, device string) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var sa syscall.Sockaddr
+	if v6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		addr := &syscall.SockaddrInet6{Port: id}
+		copy(addr.Addr[:], src.To16())
+		sa = addr
+	} else {
+		addr := &syscall.SockaddrInet4{Port: id}
+		copy(addr.Addr[:], src.To4())
+		sa = addr
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	if device != "" {
+		if err := bindToDevice(uintptr(fd), device); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	file := os.NewFile(uintptr(fd), "ping")
+	defer file.Close()
+	return net.FilePacketConn(file)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package internal
+
+import "net"
+
+// listenPing на других платформах не поддерживается: используется raw сокет
+func listenPing(v6 bool, src net.IP, id int, device string) (net.PacketConn, error) {
+	return nil, errPingUnavailable
+}
@@ -1,16 +1,23 @@
 package internal
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/sha256"
 	_ "embed"
+	"encoding/base32"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -42,21 +49,118 @@ func GetRandomJoke() string {
 const (
 	// Системная переменная для ключа шифрования
 	EncryptionKeyEnvVar = "PORT_KNOCKER_KEY"
+
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = time.Minute
 )
 
 // Config представляет конфигурацию port knocking
 type Config struct {
-	Targets []Target `yaml:"targets"`
+	Targets  []Target `yaml:"targets"`
+	Parallel int      `yaml:"parallel"` // сколько целей обрабатывать одновременно (0 или 1 - последовательно)
 }
 
 // Target представляет цель для port knocking
 type Target struct {
-	Host           string   `yaml:"host"`
-	Ports          []int    `yaml:"ports"`
-	Protocol       string   `yaml:"protocol"`        // "tcp" или "udp"
-	Delay          Duration `yaml:"delay"`           // задержка между пакетами
-	WaitConnection bool     `yaml:"wait_connection"` // ждать ли установления соединения
-	Gateway        string   `yaml:"gateway"`         // шлюз для отправки (опционально)
+	Name           string       `yaml:"name,omitempty"` // имя для выбора цели в командной строке
+	Tags           []string     `yaml:"tags,omitempty"` // метки для выбора группы целей (--tag)
+	Host           string       `yaml:"host"`
+	Ports          []PortSpec   `yaml:"ports"`                      // шаги последовательности: 7000, "8000/udp" или {port: 9000, protocol: tcp}
+	Protocol       string       `yaml:"protocol"`                   // "tcp", "udp", "icmp" или "spa"; протокол шагов без собственного
+	Delay          Duration     `yaml:"delay"`                      // задержка между пакетами
+	Jitter         Duration     `yaml:"jitter,omitempty"`           // случайный разброс каждой паузы в пределах ±jitter
+	Payload        string       `yaml:"payload,omitempty"`          // содержимое пакетов по умолчанию (hex:, base64:, text:, file:)
+	Raw            *RawOptions  `yaml:"raw,omitempty"`              // TCP knock одним сегментом через raw сокет (Linux, CAP_NET_RAW)
+	ICMP           *ICMPOptions `yaml:"icmp,omitempty"`             // как значение шага кодируется в ICMP echo request
+	WaitConnection bool         `yaml:"wait_connection"`            // ждать ли установления соединения
+	SourceAddress  string       `yaml:"source_address,omitempty"`   // локальный адрес, с которого уходят пакеты
+	SourcePort     int          `yaml:"source_port,omitempty"`      // локальный порт (0 - любой)
+	SameSourcePort bool         `yaml:"same_source_port,omitempty"` // вся последовательность с одного порта (случайного, если source_port не задан)
+	Gateway        string       `yaml:"gateway"`                    // следующий узел: пакеты уходят на его адрес через интерфейс его сети (опционально)
+	Interface      string       `yaml:"interface,omitempty"`        // интерфейс, через который уходят пакеты (например wlan0)
+	IPVersion      string       `yaml:"ip_version,omitempty"`       // 4, 6 или any (по умолчанию) - на какие адреса хоста стучать
+
+	SPA  *SPAOptions  `yaml:"spa,omitempty"`  // параметры Single Packet Authorization для protocol: spa
+	TOTP *TOTPOptions `yaml:"totp,omitempty"` // порты вычисляются из общего секрета и текущего времени вместо ports
+
+	Verify       *VerifyOptions `yaml:"verify,omitempty"`        // проверка, что защищенный порт открылся после последовательности
+	Retries      int            `yaml:"retries,omitempty"`       // сколько раз повторить всю последовательность при неудаче
+	RetryBackoff Duration       `yaml:"retry_backoff,omitempty"` // пауза перед первым повтором, удваивается с каждым следующим (по умолчанию 1s)
+
+	Exec string `yaml:"exec,omitempty"` // команда после успешной последовательности (и проверки), например "ssh {{.Host}}"
+
+	Serve *ServeOptions `yaml:"serve,omitempty"` // действия серверной стороны (команда serve)
+}
+
+// label возвращает префикс с именем цели для сообщений ("name " или пустую строку)
+func (t Target) label() string {
+	if t.Name == "" {
+		return ""
+	}
+	return t.Name + " "
+}
+
+// redactedValue заменяет секреты в Redacted
+const redactedValue = "********"
+
+// Redacted возвращает копию цели, в которой ключи SPA и секрет TOTP скрыты
+func (t Target) Redacted() Target {
+	if t.SPA != nil {
+		spa := *t.SPA
+		if spa.Key != "" {
+			spa.Key = redactedValue
+		}
+		if spa.HMACKey != "" {
+			spa.HMACKey = redactedValue
+		}
+		t.SPA = &spa
+	}
+	if t.TOTP != nil {
+		totp := *t.TOTP
+		if totp.Secret != "" {
+			totp.Secret = redactedValue
+		}
+		t.TOTP = &totp
+	}
+	return t
+}
+
+// Select возвращает цели с указанными именами и цели, у которых есть хотя бы одна из меток.
+// Без имен и меток возвращаются все цели; порядок целей из конфигурации сохраняется
+func (c *Config) Select(names, tags []string) ([]Target, error) {
+	if len(names) == 0 && len(tags) == 0 {
+		return c.Targets, nil
+	}
+
+	found := make(map[string]bool, len(names))
+	var selected []Target
+	for _, target := range c.Targets {
+		match := false
+		for _, name := range names {
+			if target.Name != "" && target.Name == name {
+				found[name] = true
+				match = true
+			}
+		}
+		for _, tag := range tags {
+			if slices.Contains(target.Tags, tag) {
+				match = true
+			}
+		}
+		if match {
+			selected = append(selected, target)
+		}
+	}
+
+	for _, name := range names {
+		if !found[name] {
+			return nil, fmt.Errorf("цель с именем '%s' не найдена в конфигурации", name)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("нет целей с метками %s", strings.Join(tags, ", "))
+	}
+	return selected, nil
 }
 
 // Duration для поддержки YAML десериализации времени
@@ -70,58 +174,188 @@ func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
 
 	duration, err := time.ParseDuration(str)
 	if err != nil {
-		return err
+		// TypeError позволяет yaml.v3 продолжить разбор и собрать все ошибки с номерами строк
+		return &yaml.TypeError{Errors: []string{
+			fmt.Sprintf("line %d: неверная длительность '%s', ожидается например 500ms или 1s", value.Line, str),
+		}}
 	}
 
 	*d = Duration(duration)
 	return nil
 }
 
+// MarshalYAML записывает длительность в том же виде, в каком она читается ("1s", "500ms")
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
 // PortKnocker основная структура для выполнения port knocking
-type PortKnocker struct{}
+type PortKnocker struct {
+	out io.Writer // куда выводятся сообщения для человека
+	mu  sync.Mutex
+}
 
 // NewPortKnocker создает новый экземпляр PortKnocker
 func NewPortKnocker() *PortKnocker {
-	return &PortKnocker{}
+	return &PortKnocker{out: os.Stdout}
+}
+
+// SetOutput задает, куда выводить сообщения для человека (по умолчанию os.Stdout)
+func (pk *PortKnocker) SetOutput(w io.Writer) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	pk.out = w
+}
+
+// printf выводит сообщение для человека
+func (pk *PortKnocker) printf(format string, args ...any) {
+	pk.mu.Lock()
+	defer pk.mu.Unlock()
+	fmt.Fprintf(pk.out, format, args...)
 }
 
 // Execute выполняет port knocking на основе конфигурации
-func (pk *PortKnocker) Execute(configFile, keyFile string, verbose bool, globalWaitConnection bool) error {
+func (pk *PortKnocker) Execute(configFile, keyFile string, verbose bool, globalWaitConnection bool) (*Report, error) {
+	return pk.ExecuteContext(context.Background(), configFile, keyFile, verbose, globalWaitConnection)
+}
+
+// ExecuteContext выполняет port knocking на основе конфигурации с поддержкой отмены через контекст
+func (pk *PortKnocker) ExecuteContext(ctx context.Context, configFile, keyFile string, verbose bool, globalWaitConnection bool) (*Report, error) {
 	// Читаем конфигурацию
 	config, err := pk.loadConfig(configFile, keyFile)
 	if err != nil {
-		return fmt.Errorf("ошибка загрузки конфигурации: %w", err)
+		return nil, fmt.Errorf("ошибка загрузки конфигурации: %w", err)
 	}
 
-	return pk.ExecuteWithConfig(config, verbose, globalWaitConnection)
+	return pk.ExecuteWithConfigContext(ctx, config, verbose, globalWaitConnection)
 }
 
 // ExecuteWithConfig выполняет port knocking с готовой конфигурацией
-func (pk *PortKnocker) ExecuteWithConfig(config *Config, verbose bool, globalWaitConnection bool) error {
+func (pk *PortKnocker) ExecuteWithConfig(config *Config, verbose bool, globalWaitConnection bool) (*Report, error) {
+	return pk.ExecuteWithConfigContext(context.Background(), config, verbose, globalWaitConnection)
+}
+
+// ExecuteWithConfigContext выполняет port knocking с готовой конфигурацией и возвращает отчет
+// по всем отправленным пакетам. Отчет возвращается и при ошибке - в нем цели, обработанные до нее.
+// При отмене контекста последовательность прерывается и возвращается *KnockInterruptedError
+func (pk *PortKnocker) ExecuteWithConfigContext(ctx context.Context, config *Config, verbose bool, globalWaitConnection bool) (*Report, error) {
+	report := &Report{StartedAt: time.Now()}
+	defer func() { report.FinishedAt = time.Now() }()
+
 	if verbose {
-		fmt.Printf("Загружена конфигурация с %d целей\n", len(config.Targets))
+		pk.printf("Загружена конфигурация с %d целей\n", len(config.Targets))
 	}
 
-	// Выполняем port knocking для каждой цели
+	targets := make([]Target, len(config.Targets))
 	for i, target := range config.Targets {
-		if verbose {
-			fmt.Printf("Цель %d/%d: %s:%v (%s)\n", i+1, len(config.Targets), target.Host, target.Ports, target.Protocol)
-		}
-
 		// Применяем глобальный флаг если не задан локально
 		if globalWaitConnection && !target.WaitConnection {
 			target.WaitConnection = true
 		}
+		targets[i] = target
+	}
 
-		if err := pk.knockTarget(target, verbose); err != nil {
-			return fmt.Errorf("ошибка при knocking цели %s: %w", target.Host, err)
+	if config.Parallel > 1 && len(targets) > 1 {
+		if err := pk.knockParallel(ctx, targets, config.Parallel, verbose, report); err != nil {
+			return report, err
+		}
+	} else {
+		// Выполняем port knocking для каждой цели
+		for i, target := range targets {
+			if verbose {
+				pk.printf("Цель %d/%d: %s%s (%s)\n", i+1, len(targets), target.label(), net.JoinHostPort(target.Host, fmt.Sprint(target.Ports)), target.DisplayProtocol())
+			}
+
+			result, err := pk.KnockTargetContext(ctx, target, verbose)
+			report.Targets = append(report.Targets, result)
+			if err != nil {
+				return report, fmt.Errorf("ошибка при knocking цели %s: %w", target.Host, err)
+			}
 		}
 	}
 
 	if verbose {
-		fmt.Println("Port knocking завершен успешно")
+		pk.printf("Port knocking завершен успешно\n")
 	}
-	return nil
+	return report, nil
+}
+
+// knockParallel обрабатывает разные цели одновременно, не более workers за раз.
+// Порядок портов и задержки внутри каждой цели сохраняются; ошибки всех целей объединяются
+func (pk *PortKnocker) knockParallel(ctx context.Context, targets []Target, workers int, verbose bool, report *Report) error {
+	if verbose {
+		pk.printf("Параллельный режим: до %d целей одновременно\n", workers)
+	}
+
+	results := make([]*TargetResult, len(targets))
+	errs := make([]error, len(targets))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for i, target := range targets {
+		// Новые цели не запускаем после отмены
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if verbose {
+				pk.printf("Цель %d/%d: %s%s (%s)\n", i+1, len(targets), target.label(), net.JoinHostPort(target.Host, fmt.Sprint(target.Ports)), target.DisplayProtocol())
+			}
+
+			result, err := pk.KnockTargetContext(ctx, target, verbose)
+			results[i] = result
+			if err != nil {
+				errs[i] = fmt.Errorf("ошибка при knocking цели %s: %w", target.Host, err)
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	// Сохраняем порядок целей из конфигурации, пропуская не запущенные
+	for _, result := range results {
+		if result != nil {
+			report.Targets = append(report.Targets, result)
+		}
+	}
+	if ctx.Err() != nil && len(report.Targets) < len(targets) {
+		errs = append(errs, fmt.Errorf("обработано %d из %d целей: %w", len(report.Targets), len(targets), ctx.Err()))
+	}
+
+	return errors.Join(errs...)
+}
+
+// KnockInterruptedError возвращается, если последовательность была прервана отменой контекста
+type KnockInterruptedError struct {
+	Host     string // цель, для которой выполнялась последовательность
+	LastPort int    // последний отправленный порт (0 если ни один пакет не был отправлен)
+	Sent     int    // сколько пакетов последовательности успели отправить
+	Total    int    // общее количество пакетов в последовательности
+	Err      error  // причина отмены (context.Canceled или context.DeadlineExceeded)
+}
+
+func (e *KnockInterruptedError) Error() string {
+	if e.Sent == 0 {
+		return fmt.Sprintf("knocking %s прерван до отправки первого пакета: %v", e.Host, e.Err)
+	}
+	return fmt.Sprintf("knocking %s прерван после порта %d (отправлено %d из %d): %v", e.Host, e.LastPort, e.Sent, e.Total, e.Err)
+}
+
+func (e *KnockInterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// LoadConfig загружает конфигурацию из файла (в том числе зашифрованного)
+func (pk *PortKnocker) LoadConfig(configFile, keyFile string) (*Config, error) {
+	return pk.loadConfig(configFile, keyFile)
 }
 
 // loadConfig загружает конфигурацию из файла с поддержкой шифрования
@@ -133,7 +367,7 @@ func (pk *PortKnocker) loadConfig(configFile, keyFile string) (*Config, error) {
 
 	// Проверяем, зашифрован ли файл (начинается с "ENCRYPTED:")
 	if strings.HasPrefix(string(data), "ENCRYPTED:") {
-		fmt.Println("Обнаружен зашифрованный файл конфигурации")
+		pk.printf("Обнаружен зашифрованный файл конфигурации\n")
 
 		// Получаем ключ шифрования
 		key, err := pk.getEncryptionKey(keyFile)
@@ -149,38 +383,85 @@ func (pk *PortKnocker) loadConfig(configFile, keyFile string) (*Config, error) {
 		data = decryptedData
 	}
 
-	// Парсим YAML
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("не удалось разобрать YAML: %w", err)
+	// Парсим YAML в строгом режиме и проверяем значения
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, err
 	}
 
-	return &config, nil
+	return config, nil
 }
 
 // getEncryptionKey получает ключ шифрования из файла или системной переменной и хеширует его
 func (pk *PortKnocker) getEncryptionKey(keyFile string) ([]byte, error) {
-	var rawKey []byte
-	var err error
+	rawKey, err := readRawKey(keyFile, EncryptionKeyEnvVar)
+	if err != nil {
+		return nil, err
+	}
 
+	// Хешируем ключ SHA256 чтобы получить всегда 32 байта для AES-256
+	hash := sha256.Sum256(rawKey)
+	return hash[:], nil
+}
+
+// readRawKey читает ключ из файла, а если файл не указан - из системной переменной envVar
+func readRawKey(keyFile, envVar string) ([]byte, error) {
 	if keyFile != "" {
 		// Читаем ключ из файла
-		rawKey, err = os.ReadFile(keyFile)
+		rawKey, err := os.ReadFile(keyFile)
 		if err != nil {
 			return nil, fmt.Errorf("не удалось прочитать файл ключа: %w", err)
 		}
-	} else {
-		// Пытаемся получить ключ из системной переменной
-		key := os.Getenv(EncryptionKeyEnvVar)
-		if key == "" {
-			return nil, fmt.Errorf("ключ шифрования не найден ни в файле, ни в переменной %s", EncryptionKeyEnvVar)
+		return rawKey, nil
+	}
+
+	// Пытаемся получить ключ из системной переменной
+	key := os.Getenv(envVar)
+	if key == "" {
+		return nil, fmt.Errorf("ключ шифрования не найден ни в файле, ни в переменной %s", envVar)
+	}
+	return []byte(key), nil
+}
+
+// loadKey возвращает ключ из значения в конфигурации, файла или системной переменной
+func loadKey(value, keyFile, envVar string) ([]byte, error) {
+	raw := []byte(value)
+	if value == "" {
+		var err error
+		raw, err = readRawKey(keyFile, envVar)
+		if err != nil {
+			return nil, err
 		}
-		rawKey = []byte(key)
 	}
+	return decodeKeyMaterial(raw)
+}
 
-	// Хешируем ключ SHA256 чтобы получить всегда 32 байта для AES-256
-	hash := sha256.Sum256(rawKey)
-	return hash[:], nil
+// decodeKeyMaterial убирает перевод строки в конце и декодирует значения с префиксами base64: и base32:
+func decodeKeyMaterial(raw []byte) ([]byte, error) {
+	value := strings.TrimSpace(string(raw))
+	if value == "" {
+		return nil, fmt.Errorf("пустой ключ")
+	}
+
+	if encoded, ok := strings.CutPrefix(value, "base64:"); ok {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось декодировать base64: %w", err)
+		}
+		return decoded, nil
+	}
+
+	if encoded, ok := strings.CutPrefix(value, "base32:"); ok {
+		// Секреты TOTP обычно записывают base32 без выравнивания
+		encoded = strings.TrimRight(strings.ToUpper(encoded), "=")
+		decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось декодировать base32: %w", err)
+		}
+		return decoded, nil
+	}
+
+	return []byte(value), nil
 }
 
 // decrypt расшифровывает данные с помощью AES-GCM
@@ -220,192 +501,358 @@ func (pk *PortKnocker) decrypt(encryptedData []byte, key []byte) ([]byte, error)
 	return plaintext, nil
 }
 
-// knockTarget выполняет port knocking для одной цели
-func (pk *PortKnocker) knockTarget(target Target, verbose bool) error {
+// KnockTargetContext выполняет port knocking для одной цели с поддержкой отмены через контекст.
+// Результат возвращается всегда, в том числе вместе с ошибкой
+func (pk *PortKnocker) KnockTargetContext(ctx context.Context, target Target, verbose bool) (*TargetResult, error) {
+	result := &TargetResult{
+		Name:      target.Name,
+		Host:      target.Host,
+		Protocol:  target.DisplayProtocol(),
+		Ports:     target.PortNumbers(),
+		StartedAt: time.Now(),
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		// Последовательность всегда повторяется целиком: сервер сбрасывает ее при неверном порядке
+		attemptResult := AttemptResult{Number: attempt, StartedAt: time.Now()}
+		result.Packets, result.Verify = nil, nil
+
+		err = pk.knockTarget(ctx, target, verbose, result)
+		if err == nil && target.Verify != nil {
+			result.Verify = pk.verifyTarget(ctx, target, verbose)
+			if !result.Verify.Reachable {
+				err = fmt.Errorf("после последовательности %s недоступен: %w", result.Verify.Address, result.Verify.Err)
+			}
+		}
+
+		attemptResult.Packets = result.Packets
+		attemptResult.Verify = result.Verify
+		attemptResult.Err = err
+		attemptResult.FinishedAt = time.Now()
+		result.Attempts = append(result.Attempts, attemptResult)
+
+		// Ошибки конфигурации (до отправки первого пакета) и прерывание не повторяем
+		if err == nil || ctx.Err() != nil || len(result.Packets) == 0 || attempt > target.Retries {
+			break
+		}
+
+		backoff := retryBackoff(target.RetryBackoff, attempt)
+		if verbose {
+			pk.printf("  Попытка %d/%d не удалась: %v; повтор через %v\n", attempt, target.Retries+1, err, backoff)
+		}
+		if sleepErr := sleepContext(ctx, backoff); sleepErr != nil {
+			break
+		}
+	}
+
+	if err != nil && len(result.Attempts) > 1 {
+		err = fmt.Errorf("последовательность не удалась после %d попыток: %w", len(result.Attempts), err)
+	}
+	result.FinishedAt = time.Now()
+	result.Err = err
+	return result, err
+}
+
+// retryBackoff возвращает паузу перед повтором после попытки attempt: base, 2*base, 4*base...
+func retryBackoff(base Duration, attempt int) time.Duration {
+	backoff := time.Duration(base)
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+// knockTarget выполняет port knocking для одной цели, записывая каждый пакет в result
+func (pk *PortKnocker) knockTarget(ctx context.Context, target Target, verbose bool, result *TargetResult) error {
 	// Проверяем на "шутливую" цель 1
-	if target.Host == "8.8.8.8" && len(target.Ports) == 1 && target.Ports[0] == 8888 {
+	if target.Host == "8.8.8.8" && len(target.Ports) == 1 && target.Ports[0].Port == 8888 {
 		pk.showEasterEgg()
 		return nil
 	}
 
 	// Проверяем на "шутливую" цель 2
-	if target.Host == "1.1.1.1" && len(target.Ports) == 1 && target.Ports[0] == 1111 {
+	if target.Host == "1.1.1.1" && len(target.Ports) == 1 && target.Ports[0].Port == 1111 {
 		pk.showRandomJoke()
 		return nil
 	}
 
-	protocol := strings.ToLower(target.Protocol)
-	if protocol != "tcp" && protocol != "udp" {
-		return fmt.Errorf("неподдерживаемый протокол: %s", target.Protocol)
+	// Для TOTP последовательности порты вычисляются из секрета для текущего окна времени
+	if target.TOTP != nil {
+		if len(target.Ports) > 0 {
+			return fmt.Errorf("ports и totp нельзя задавать одновременно")
+		}
+		ports, window, err := target.TOTP.Ports(time.Now())
+		if err != nil {
+			return fmt.Errorf("не удалось вычислить TOTP последовательность: %w", err)
+		}
+		if verbose {
+			pk.printf("  TOTP окно %d: порты %v\n", window, ports)
+		}
+		target.Ports = portSpecs(ports)
+		result.Ports = ports
 	}
 
-	// Вычисляем таймаут как половину интервала между пакетами
-	timeout := time.Duration(target.Delay) / 2
-	if timeout < 100*time.Millisecond {
-		timeout = 100 * time.Millisecond // минимальный таймаут
+	if strings.EqualFold(target.Protocol, "spa") {
+		return pk.knockSPA(ctx, target, verbose, result)
+	}
+	steps := target.steps()
+	for _, step := range steps {
+		if step.Protocol != "tcp" && step.Protocol != "udp" && step.Protocol != "icmp" {
+			return fmt.Errorf("неподдерживаемый протокол порта %d: '%s'", step.Port, step.Protocol)
+		}
 	}
 
-	for i, port := range target.Ports {
-		if verbose {
-			fmt.Printf("  Отправка пакета на %s:%d (%s)\n", target.Host, port, protocol)
+	interrupted := func(sent int) error {
+		lastPort := 0
+		if sent > 0 {
+			lastPort = steps[sent-1].Port
+		}
+		return &KnockInterruptedError{
+			Host:     target.Host,
+			LastPort: lastPort,
+			Sent:     sent,
+			Total:    len(steps),
+			Err:      ctx.Err(),
 		}
+	}
 
-		if err := pk.sendPacket(target.Host, port, protocol, target.WaitConnection, timeout, target.Gateway); err != nil {
-			if target.WaitConnection {
-				return fmt.Errorf("ошибка отправки пакета на порт %d: %w", port, err)
-			} else {
-				if verbose {
-					fmt.Printf("  Предупреждение: не удалось отправить пакет на порт %d: %v\n", port, err)
-				}
-			}
+	source, err := target.source()
+	if err != nil {
+		return err
+	}
+	if target.WaitConnection && source.Gateway != nil {
+		return fmt.Errorf("пакеты через шлюз %s не устанавливают соединение, wait_connection с ним не используется", source.Gateway)
+	}
+	if target.SameSourcePort && source.Port == 0 {
+		source.Port = ephemeralPort()
+	}
+	if verbose && (source.IP != nil || source.Port != 0 || source.Interface != "") {
+		pk.printf("  Источник: %s\n", source)
+	}
+
+	addrs, err := resolveHost(ctx, target.Host, target.ipVersion(), source.IP)
+	if err != nil {
+		if ctx.Err() != nil {
+			return interrupted(0)
 		}
+		return err
+	}
 
-		// Задержка между пакетами (кроме последнего)
-		if i < len(target.Ports)-1 {
-			delay := time.Duration(target.Delay)
+	rawWarned := false
+	var stepStarted time.Time
+	for i, step := range steps {
+		port := step.Port
+
+		// Пауза перед шагом: delay шага или цели со случайным разбросом jitter. Она отсчитывается
+		// от начала предыдущего шага, как в плане --dry-run, поэтому время dial входит в паузу
+		if target.hasPause(i) {
+			delay := withJitter(target.stepDelay(i), time.Duration(target.Jitter))
+			if !stepStarted.IsZero() {
+				delay -= time.Since(stepStarted)
+			}
 			if delay > 0 {
 				if verbose {
-					fmt.Printf("  Ожидание %v...\n", delay)
+					pk.printf("  Ожидание %v...\n", delay.Round(time.Millisecond))
+				}
+				if err := sleepContext(ctx, delay); err != nil {
+					return interrupted(i)
 				}
-				time.Sleep(delay)
 			}
 		}
-	}
 
-	return nil
-}
+		if ctx.Err() != nil {
+			return interrupted(i)
+		}
+		stepStarted = time.Now()
 
-// sendPacket отправляет один пакет на указанный хост и порт
-func (pk *PortKnocker) sendPacket(host string, port int, protocol string, waitConnection bool, timeout time.Duration, gateway string) error {
-	address := fmt.Sprintf("%s:%d", host, port)
+		stepSource := source
+		if step.SourcePort != 0 {
+			stepSource.Port = step.SourcePort
+		}
 
-	var conn net.Conn
-	var err error
+		// Шаг отправляется на каждый адрес хоста, например и на A, и на AAAA запись
+		for _, addr := range addrs {
+			request := knockPacket{
+				Host:     addr.String(),
+				Port:     port,
+				Protocol: step.Protocol,
+				Timeout:  target.dialTimeout(i),
+				Source:   stepSource,
+				Raw:      target.Raw,
+				ICMP:     target.ICMP,
+			}
+			if spec := target.stepPayload(step); spec != "" {
+				data, err := newPayloadData(target.Host, port, step.Protocol)
+				if err != nil {
+					return err
+				}
+				if request.Payload, err = buildPayload(spec, data); err != nil {
+					return fmt.Errorf("payload порта %d: %w", port, err)
+				}
+			}
 
-	// Настройка локального адреса если указан шлюз
-	var localAddr net.Addr
-	if gateway != "" {
-		if strings.Contains(gateway, ":") {
-			localAddr, err = net.ResolveTCPAddr("tcp", gateway)
-			if err != nil {
-				return fmt.Errorf("не удалось разрешить адрес шлюза %s: %w", gateway, err)
+			if verbose {
+				address := net.JoinHostPort(request.Host, strconv.Itoa(port))
+				if step.Protocol == "icmp" {
+					pk.printf("  Отправка echo request на %s (icmp %s=%d)\n", request.Host, target.ICMP.encoding(), port)
+				} else if len(request.Payload) > 0 {
+					pk.printf("  Отправка пакета на %s (%s, %d байт)\n", address, step.Protocol, len(request.Payload))
+				} else {
+					pk.printf("  Отправка пакета на %s (%s)\n", address, step.Protocol)
+				}
 			}
-		} else {
-			// Если указан только IP, добавляем порт 0
-			localAddr, err = net.ResolveTCPAddr("tcp", gateway+":0")
-			if err != nil {
-				return fmt.Errorf("не удалось разрешить адрес шлюза %s: %w", gateway, err)
+
+			packet := pk.sendPacket(ctx, request)
+			// Отмена во время dial не считается отправкой: пакет не ушел
+			if ctx.Err() != nil && !packet.Sent() {
+				return interrupted(i)
 			}
-		}
-	}
+			result.Packets = append(result.Packets, packet)
 
-	switch protocol {
-	case "tcp":
-		if localAddr != nil {
-			dialer := &net.Dialer{
-				LocalAddr: localAddr,
-				Timeout:   timeout,
+			if verbose && request.Raw != nil && step.Protocol == "tcp" && !packet.Raw && packet.Outcome != OutcomeFailed && !rawWarned {
+				rawWarned = true
+				pk.printf("  Предупреждение: raw сокеты недоступны (нужен Linux и CAP_NET_RAW), TCP пакеты отправляются через dial\n")
+			}
+
+			if target.WaitConnection && packet.Outcome != OutcomeConnected && packet.Outcome != OutcomeSent {
+				return fmt.Errorf("ошибка отправки пакета на порт %d: %w", port, packet.Err)
 			}
-			conn, err = dialer.Dial("tcp", address)
-		} else {
-			conn, err = net.DialTimeout("tcp", address, timeout)
-		}
-	case "udp":
-		if localAddr != nil {
-			dialer := &net.Dialer{
-				LocalAddr: localAddr,
-				Timeout:   timeout,
+			if !packet.Sent() && verbose {
+				pk.printf("  Предупреждение: не удалось отправить пакет на порт %d: %v\n", port, packet.Err)
 			}
-			conn, err = dialer.Dial("udp", address)
-		} else {
-			conn, err = net.DialTimeout("udp", address, timeout)
 		}
-	default:
-		return fmt.Errorf("неподдерживаемый протокол: %s", protocol)
 	}
 
-	if err != nil {
-		if waitConnection {
-			return fmt.Errorf("не удалось подключиться к %s: %w", address, err)
-		} else {
-			// Для UDP и TCP без ожидания соединения просто отправляем пакет
-			return pk.sendPacketWithoutConnection(host, port, protocol, localAddr)
-		}
-	}
-	defer conn.Close()
+	return nil
+}
 
-	// Отправляем пустой пакет
-	_, err = conn.Write([]byte{})
-	if err != nil {
-		return fmt.Errorf("не удалось отправить пакет: %w", err)
+// sleepContext ждет указанное время или отмену контекста
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
+}
 
-	return nil
+// knockPacket описывает один отправляемый пакет последовательности
+type knockPacket struct {
+	Host     string
+	Port     int
+	Protocol string
+	Timeout  time.Duration
+	Source   sourceBinding
+	Payload  []byte       // содержимое UDP датаграммы или данные после установления TCP соединения
+	Raw      *RawOptions  // отправить TCP сегмент через raw сокет вместо dial
+	ICMP     *ICMPOptions // кодирование значения шага для icmp
 }
 
-// sendPacketWithoutConnection отправляет пакет без установления соединения
-func (pk *PortKnocker) sendPacketWithoutConnection(host string, port int, protocol string, localAddr net.Addr) error {
-	address := fmt.Sprintf("%s:%d", host, port)
+// sendPacket отправляет один пакет на указанный хост и порт и возвращает результат отправки.
+// Неудачный TCP dial с RST или таймаутом означает, что SYN все же ушел в сеть
+func (pk *PortKnocker) sendPacket(ctx context.Context, packet knockPacket) (result PacketResult) {
+	host, port, protocol := packet.Host, packet.Port, packet.Protocol
+	address := net.JoinHostPort(host, strconv.Itoa(port))
 
-	switch protocol {
-	case "udp":
-		// Для UDP просто отправляем пакет
-		var conn net.Conn
-		var err error
+	result = PacketResult{
+		Port:      port,
+		Protocol:  protocol,
+		StartedAt: time.Now(),
+	}
+	defer func() { result.FinishedAt = time.Now() }()
 
-		if localAddr != nil {
-			dialer := &net.Dialer{
-				LocalAddr: localAddr,
-			}
-			conn, err = dialer.Dial("udp", address)
-		} else {
-			conn, err = net.Dial("udp", address)
-		}
+	fail := func(err error) PacketResult {
+		result.Outcome = OutcomeFailed
+		result.Err = err
+		return result
+	}
 
-		if err != nil {
-			return fmt.Errorf("не удалось создать UDP соединение к %s: %w", address, err)
+	// Через шлюз пакет собирается целиком и уходит кадром на адрес шлюза
+	if packet.Source.Gateway != nil {
+		if err := sendViaGateway(ctx, packet, &result); err != nil {
+			return fail(err)
 		}
-		defer conn.Close()
+		result.Outcome = OutcomeSent
+		return result
+	}
 
-		_, err = conn.Write([]byte{})
-		if err != nil {
-			return fmt.Errorf("не удалось отправить UDP пакет: %w", err)
+	switch protocol {
+	case "tcp", "udp":
+	case "icmp":
+		if err := sendICMP(ctx, packet, &result); err != nil {
+			return fail(err)
 		}
+		result.Outcome = OutcomeSent
+		return result
+	default:
+		return fail(fmt.Errorf("неподдерживаемый протокол: %s", protocol))
+	}
 
-	case "tcp":
-		// Для TCP без ожидания соединения используем короткий таймаут
-		var conn net.Conn
-		var err error
-
-		if localAddr != nil {
-			dialer := &net.Dialer{
-				LocalAddr: localAddr,
-				Timeout:   100 * time.Millisecond,
-			}
-			conn, err = dialer.Dial("tcp", address)
-		} else {
-			conn, err = net.DialTimeout("tcp", address, 100*time.Millisecond)
+	if protocol == "tcp" && packet.Raw != nil {
+		err := sendRawTCP(ctx, packet, &result)
+		if err == nil {
+			result.Outcome = OutcomeSent
+			result.Raw = true
+			result.PayloadSize = len(packet.Payload)
+			return result
 		}
-
-		if err != nil {
-			// Для TCP без ожидания соединения игнорируем ошибки подключения
-			return nil
+		if !errors.Is(err, errRawUnavailable) {
+			return fail(fmt.Errorf("raw отправка: %w", err))
 		}
-		defer conn.Close()
+		// Нет прав на raw сокет - отправляем обычным dial
+		result.LocalAddr, result.RemoteAddr = "", ""
+	}
 
-		_, err = conn.Write([]byte{})
-		if err != nil {
-			return fmt.Errorf("не удалось отправить TCP пакет: %w", err)
+	var bound net.Addr
+	conn, err := packet.Source.boundDialer(protocol, packet.Timeout, &bound).DialContext(ctx, protocol, address)
+	if err != nil {
+		result.fillAddrsFromError(err)
+		if result.LocalAddr == "" && bound != nil {
+			// Отказ и таймаут - обычный исход стука: адрес источника известен из bind
+			result.LocalAddr = bound.String()
 		}
+		result.Outcome = classifyDialError(err)
+		result.Err = err
+		return result
 	}
+	defer conn.Close()
 
-	return nil
+	result.RemoteAddr = conn.RemoteAddr().String()
+	result.LocalAddr = conn.LocalAddr().String()
+	if tcpConn, ok := conn.(*net.TCPConn); ok && packet.Source.Port != 0 {
+		// Закрытие с RST не оставляет TIME_WAIT, и следующий стук с того же порта не упрется в него
+		tcpConn.SetLinger(0)
+	}
+
+	// Отправляем payload (пустой, если не задан)
+	written, err := conn.Write(packet.Payload)
+	if err != nil {
+		return fail(fmt.Errorf("не удалось отправить пакет: %w", err))
+	}
+	result.PayloadSize = written
+
+	if protocol == "udp" {
+		result.Outcome = OutcomeSent
+	} else {
+		result.Outcome = OutcomeConnected
+	}
+	return result
 }
 
 // showEasterEgg показывает забавный ASCII-арт
 func (pk *PortKnocker) showEasterEgg() {
-	fmt.Println("\n🎯 🎯 🎯  EASTER EGG ACTIVATED! 🎯 🎯 🎯")
-	fmt.Println()
+	fmt.Fprintln(pk.out, "\n🎯 🎯 🎯  EASTER EGG ACTIVATED! 🎯 🎯 🎯")
+	fmt.Fprintln(pk.out)
 
 	// Анимированный ASCII-арт
 	frames := []string{
@@ -439,15 +886,15 @@ func (pk *PortKnocker) showEasterEgg() {
 	}
 
 	for i := 0; i < 3; i++ {
-		fmt.Print("\033[2J\033[H") // Очистка экрана
-		fmt.Println(frames[i%len(frames)])
+		fmt.Fprint(pk.out, "\033[2J\033[H") // Очистка экрана
+		fmt.Fprintln(pk.out, frames[i%len(frames)])
 		time.Sleep(1500 * time.Millisecond)
 	}
 
-	fmt.Println("\n🎉 Поздравляем! Вы нашли пасхалку!")
-	fmt.Println("🎯 Попробуйте: ./port-knocker -t \"tcp:8.8.8.8:8888\"")
-	fmt.Println("🚀 Port Knocker - теперь с пасхалками!")
-	fmt.Println()
+	fmt.Fprintln(pk.out, "\n🎉 Поздравляем! Вы нашли пасхалку!")
+	fmt.Fprintln(pk.out, "🎯 Попробуйте: ./port-knocker -t \"tcp:8.8.8.8:8888\"")
+	fmt.Fprintln(pk.out, "🚀 Port Knocker - теперь с пасхалками!")
+	fmt.Fprintln(pk.out)
 }
 
 func (pk *PortKnocker) showRandomJoke() {
@@ -556,49 +1003,49 @@ func (pk *PortKnocker) showRandomJoke() {
 		maxLength = minWidth
 	}
 
-	fmt.Println()
-	fmt.Printf("%s%s╭%s", colorPurple, colorBold, colorReset)
-	fmt.Printf("%s%s", colorYellow, strings.Repeat("─", maxLength+2))
-	fmt.Printf("%s%s╮%s\n", colorPurple, colorBold, colorReset)
+	fmt.Fprintln(pk.out)
+	fmt.Fprintf(pk.out, "%s%s╭%s", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s", colorYellow, strings.Repeat("─", maxLength+2))
+	fmt.Fprintf(pk.out, "%s%s╮%s\n", colorPurple, colorBold, colorReset)
 
 	headerText := " Зацени Анектотец! 🤣 "
-	fmt.Printf("%s%s│%s", colorPurple, colorBold, colorReset)
-	fmt.Printf("%s%s%s%s", colorCyan, colorBold, headerText, colorReset)
-	fmt.Printf("%s%s", colorYellow, strings.Repeat(" ", 1+maxLength-visibleLength(headerText)))
-	fmt.Printf("%s%s│%s\n", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s│%s", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s%s%s", colorCyan, colorBold, headerText, colorReset)
+	fmt.Fprintf(pk.out, "%s%s", colorYellow, strings.Repeat(" ", 1+maxLength-visibleLength(headerText)))
+	fmt.Fprintf(pk.out, "%s%s│%s\n", colorPurple, colorBold, colorReset)
 
-	fmt.Printf("%s%s├%s", colorPurple, colorBold, colorReset)
-	fmt.Printf("%s%s", colorYellow, strings.Repeat("─", maxLength+2))
-	fmt.Printf("%s%s┤%s\n", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s├%s", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s", colorYellow, strings.Repeat("─", maxLength+2))
+	fmt.Fprintf(pk.out, "%s%s┤%s\n", colorPurple, colorBold, colorReset)
 
 	// Выводим обработанные строки шутки
 	for _, line := range processedLines {
-		fmt.Printf("%s%s│%s", colorPurple, colorBold, colorReset)
-		fmt.Printf("%s%s%s", colorWhite, line, colorReset)
-		fmt.Printf("%s%s", colorYellow, strings.Repeat(" ", 2+maxLength-len([]rune(line))))
-		fmt.Printf("%s%s│%s\n", colorPurple, colorBold, colorReset)
+		fmt.Fprintf(pk.out, "%s%s│%s", colorPurple, colorBold, colorReset)
+		fmt.Fprintf(pk.out, "%s%s%s", colorWhite, line, colorReset)
+		fmt.Fprintf(pk.out, "%s%s", colorYellow, strings.Repeat(" ", 2+maxLength-len([]rune(line))))
+		fmt.Fprintf(pk.out, "%s%s│%s\n", colorPurple, colorBold, colorReset)
 	}
 
-	fmt.Printf("%s%s├%s", colorPurple, colorBold, colorReset)
-	fmt.Printf("%s%s", colorYellow, strings.Repeat("─", maxLength+2))
-	fmt.Printf("%s%s┤%s\n", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s├%s", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s", colorYellow, strings.Repeat("─", maxLength+2))
+	fmt.Fprintf(pk.out, "%s%s┤%s\n", colorPurple, colorBold, colorReset)
 
 	// Вычисляем правильную ширину для нижних строк
 	cmdText := "Попробуйте: ./port-knocker -t \"tcp:1.1.1.1:1111\""
 	titleText := "🚀 Port Knocker - теперь с шутками! 🤣"
 
-	fmt.Printf("%s%s│%s", colorPurple, colorBold, colorReset)
-	fmt.Printf("%s%s%s%s", colorGreen, colorBold, cmdText, colorReset)
-	fmt.Printf("%s%s", colorYellow, strings.Repeat(" ", 2+maxLength-visibleLength(cmdText)))
-	fmt.Printf("%s%s│%s\n", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s│%s", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s%s%s", colorGreen, colorBold, cmdText, colorReset)
+	fmt.Fprintf(pk.out, "%s%s", colorYellow, strings.Repeat(" ", 2+maxLength-visibleLength(cmdText)))
+	fmt.Fprintf(pk.out, "%s%s│%s\n", colorPurple, colorBold, colorReset)
 
-	fmt.Printf("%s%s│%s", colorPurple, colorBold, colorReset)
-	fmt.Printf("%s%s%s%s", colorBlue, colorBold, titleText, colorReset)
-	fmt.Printf("%s%s", colorYellow, strings.Repeat(" ", maxLength-visibleLength(titleText)))
-	fmt.Printf("%s%s│%s\n", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s│%s", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s%s%s", colorBlue, colorBold, titleText, colorReset)
+	fmt.Fprintf(pk.out, "%s%s", colorYellow, strings.Repeat(" ", maxLength-visibleLength(titleText)))
+	fmt.Fprintf(pk.out, "%s%s│%s\n", colorPurple, colorBold, colorReset)
 
-	fmt.Printf("%s%s╰%s", colorPurple, colorBold, colorReset)
-	fmt.Printf("%s%s", colorYellow, strings.Repeat("─", maxLength+2))
-	fmt.Printf("%s%s╯%s\n", colorPurple, colorBold, colorReset)
-	fmt.Println()
+	fmt.Fprintf(pk.out, "%s%s╰%s", colorPurple, colorBold, colorReset)
+	fmt.Fprintf(pk.out, "%s%s", colorYellow, strings.Repeat("─", maxLength+2))
+	fmt.Fprintf(pk.out, "%s%s╯%s\n", colorPurple, colorBold, colorReset)
+	fmt.Fprintln(pk.out)
 }
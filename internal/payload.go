@@ -0,0 +1,96 @@
+package internal
+
+import (
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// PayloadData содержит данные, доступные в шаблоне payload
+type PayloadData struct {
+	Host      string
+	Port      int
+	Protocol  string
+	Timestamp int64  // unix время отправки в секундах
+	Nonce     string // 16 случайных байт в hex, свои для каждого пакета
+}
+
+// newPayloadData собирает данные шаблона для пакета, отправляемого сейчас
+func newPayloadData(host string, port int, protocol string) (PayloadData, error) {
+	nonce := make([]byte, 16)
+	if _, err := crand.Read(nonce); err != nil {
+		return PayloadData{}, fmt.Errorf("не удалось получить случайные данные: %w", err)
+	}
+	return PayloadData{
+		Host:      host,
+		Port:      port,
+		Protocol:  protocol,
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+	}, nil
+}
+
+// buildPayload подставляет данные в шаблон и декодирует содержимое по префиксу:
+// hex:, base64:, text: (по умолчанию) или file: - путь к файлу, содержимое которого отправляется как есть
+func buildPayload(spec string, data PayloadData) ([]byte, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	rendered, err := renderTemplate("payload", spec, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodePayload(rendered)
+}
+
+func decodePayload(value string) ([]byte, error) {
+	kind, content, ok := strings.Cut(value, ":")
+	if !ok {
+		return []byte(value), nil
+	}
+
+	switch kind {
+	case "hex":
+		decoded, err := hex.DecodeString(strings.Join(strings.Fields(content), ""))
+		if err != nil {
+			return nil, fmt.Errorf("не удалось декодировать hex payload: %w", err)
+		}
+		return decoded, nil
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+		if err != nil {
+			return nil, fmt.Errorf("не удалось декодировать base64 payload: %w", err)
+		}
+		return decoded, nil
+	case "text":
+		return []byte(content), nil
+	case "file":
+		data, err := os.ReadFile(content)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось прочитать файл payload: %w", err)
+		}
+		return data, nil
+	default:
+		// Двоеточие внутри обычного текста, например "user:pass"
+		return []byte(value), nil
+	}
+}
+
+// checkPayload проверяет payload без отправки: шаблон разбирается, а payload без шаблона
+// декодируется полностью (включая чтение файла)
+func checkPayload(spec string) error {
+	data, err := newPayloadData("host", 1, "tcp")
+	if err != nil {
+		return err
+	}
+	if strings.Contains(spec, "{{") {
+		_, err := renderTemplate("payload", spec, data)
+		return err
+	}
+	_, err = decodePayload(spec)
+	return err
+}
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PlanStep описывает пакет, который был бы отправлен (--dry-run)
+type PlanStep struct {
+	Offset     time.Duration // время от начала цели без учета разброса
+	Delay      time.Duration // пауза перед шагом
+	Jitter     time.Duration // разброс паузы (±)
+	Payload    string        // payload шага как в конфигурации (шаблоны подставляются при отправке)
+	RawFlags   string        // TCP флаги, если сегмент отправляется через raw сокет
+	Encoding   string        // для icmp: поле echo request со значением шага
+	Port       int
+	Protocol   string
+	RemoteAddr string // разрешенный адрес цели
+	LocalAddr  string // локальный адрес (шлюз или адрес по таблице маршрутизации)
+}
+
+// TargetPlan описывает последовательность одной цели без отправки пакетов
+type TargetPlan struct {
+	Name      string
+	Host      string
+	Protocol  string
+	Wait      bool
+	Interface string // интерфейс, через который уходят пакеты (пусто - по таблице маршрутизации)
+	Gateway   string // следующий узел на Interface (пусто - по таблице маршрутизации)
+	SamePort  bool   // все пакеты с одного порта источника (случайного, выбираемого при отправке)
+	Steps     []PlanStep
+	Verify    string // адрес проверки после последовательности (пусто если verify не задан)
+	Retries   int
+	Exec      string
+	Err       error // ошибка разрешения имени, шлюза или конфигурации
+}
+
+// PlanConfig строит план для всех целей конфигурации, ничего не отправляя
+func (pk *PortKnocker) PlanConfig(ctx context.Context, config *Config, globalWaitConnection bool) ([]*TargetPlan, error) {
+	var plans []*TargetPlan
+	var failed int
+	for _, target := range config.Targets {
+		if globalWaitConnection {
+			target.WaitConnection = true
+		}
+		plan := pk.PlanTarget(ctx, target)
+		if plan.Err != nil {
+			failed++
+		}
+		plans = append(plans, plan)
+	}
+	if failed > 0 {
+		return plans, fmt.Errorf("не удалось построить план для %d из %d целей", failed, len(plans))
+	}
+	return plans, nil
+}
+
+// PlanTarget разрешает адреса и вычисляет время отправки каждого пакета цели
+func (pk *PortKnocker) PlanTarget(ctx context.Context, target Target) *TargetPlan {
+	protocol := strings.ToLower(target.Protocol)
+	plan := &TargetPlan{
+		Name:     target.Name,
+		Host:     target.Host,
+		Protocol: target.DisplayProtocol(),
+		Wait:     target.WaitConnection,
+		Retries:  target.Retries,
+		Exec:     target.Exec,
+	}
+
+	if target.TOTP != nil {
+		totpPorts, _, err := target.TOTP.Ports(time.Now())
+		if err != nil {
+			plan.Err = fmt.Errorf("не удалось вычислить TOTP последовательность: %w", err)
+			return plan
+		}
+		target.Ports = portSpecs(totpPorts)
+	}
+
+	steps := target.steps()
+	if protocol == "spa" {
+		// SPA - один UDP пакет на порт fwknopd
+		steps = []PortSpec{{Port: DefaultSPAPort, Protocol: "udp"}}
+		if len(target.Ports) > 0 {
+			steps[0].Port = target.Ports[0].Port
+		}
+	}
+	for _, step := range steps {
+		if step.Protocol != "tcp" && step.Protocol != "udp" && step.Protocol != "icmp" {
+			plan.Err = fmt.Errorf("неподдерживаемый протокол порта %d: '%s'", step.Port, step.Protocol)
+			return plan
+		}
+	}
+
+	source, err := target.source()
+	if err != nil {
+		plan.Err = err
+		return plan
+	}
+	plan.Interface = source.Interface
+	if source.Gateway != nil {
+		plan.Gateway = source.Gateway.String()
+	}
+	plan.SamePort = target.SameSourcePort && source.Port == 0
+
+	remote, err := resolveHost(ctx, target.Host, target.ipVersion(), source.IP)
+	if err != nil {
+		plan.Err = err
+		return plan
+	}
+	if protocol == "spa" {
+		remote = remote[:1] // SPA пакет отправляется на один адрес
+	}
+
+	var offset time.Duration
+	for i, spec := range steps {
+		step := PlanStep{Port: spec.Port, Protocol: spec.Protocol}
+		if protocol != "spa" {
+			step.Payload = target.stepPayload(spec)
+		}
+		if target.Raw != nil && spec.Protocol == "tcp" {
+			step.RawFlags = strings.ToUpper(target.Raw.Flags)
+			if step.RawFlags == "" {
+				step.RawFlags = defaultRawFlags
+			}
+		}
+		if protocol != "spa" && target.hasPause(i) {
+			step.Delay = target.stepDelay(i)
+			step.Jitter = time.Duration(target.Jitter)
+		}
+		offset += step.Delay
+		step.Offset = offset
+
+		stepSource := source
+		if spec.SourcePort != 0 {
+			stepSource.Port = spec.SourcePort
+		}
+		// Шаг уходит на каждый адрес хоста; пауза - только перед первым из них
+		for j, ip := range remote {
+			if j > 0 {
+				step.Delay, step.Jitter = 0, 0
+			}
+			address := net.JoinHostPort(ip.String(), strconv.Itoa(spec.Port))
+			step.RemoteAddr = address
+			step.LocalAddr = planLocalAddr(ctx, address, stepSource)
+			if spec.Protocol == "icmp" {
+				// У ICMP нет портов: значение шага передается в поле echo request
+				step.RemoteAddr = ip.String()
+				step.Encoding = target.ICMP.encoding()
+			}
+			plan.Steps = append(plan.Steps, step)
+		}
+	}
+
+	if target.Verify != nil {
+		host := target.Verify.Host
+		if host == "" {
+			host = target.Host
+		}
+		verifyProtocol := strings.ToLower(target.Verify.Protocol)
+		if verifyProtocol == "" {
+			verifyProtocol = "tcp"
+		}
+		plan.Verify = net.JoinHostPort(host, strconv.Itoa(target.Verify.Port)) + "/" + verifyProtocol
+	}
+
+	return plan
+}
+
+// planLocalAddr определяет локальный адрес, с которого ушел бы пакет. Для этого используется
+// UDP сокет: connect для UDP только выбирает маршрут и ничего не отправляет
+func planLocalAddr(ctx context.Context, remote string, source sourceBinding) string {
+	host := ""
+	if source.IP != nil {
+		host = source.IP.String()
+	} else {
+		conn, err := sourceBinding{Interface: source.Interface}.dialer("udp", 0).DialContext(ctx, "udp", remote)
+		if err != nil {
+			return ""
+		}
+		defer conn.Close()
+		host, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+	if source.Port != 0 {
+		return net.JoinHostPort(host, strconv.Itoa(source.Port))
+	}
+	return host
+}
+
+// WritePlan выводит план в виде временной шкалы
+func WritePlan(w io.Writer, plans []*TargetPlan) {
+	for i, plan := range plans {
+		fmt.Fprintf(w, "Цель %d/%d: ", i+1, len(plans))
+		if plan.Name != "" {
+			fmt.Fprintf(w, "%s ", plan.Name)
+		}
+		fmt.Fprintf(w, "%s (%s)", plan.Host, plan.Protocol)
+		if plan.Wait {
+			fmt.Fprint(w, ", ждать соединения")
+		}
+		switch {
+		case plan.Gateway != "":
+			fmt.Fprintf(w, ", через шлюз %s (%s)", plan.Gateway, plan.Interface)
+		case plan.Interface != "":
+			fmt.Fprintf(w, ", через %s", plan.Interface)
+		}
+		if plan.SamePort {
+			fmt.Fprint(w, ", один порт источника")
+		}
+		fmt.Fprintln(w)
+
+		if plan.Err != nil {
+			fmt.Fprintf(w, "  ОШИБКА: %v\n", plan.Err)
+			continue
+		}
+		for _, step := range plan.Steps {
+			offset := formatOffset(step.Offset)
+			if step.Jitter > 0 {
+				offset += " ±" + formatOffset(step.Jitter)
+			}
+			fmt.Fprintf(w, "  t+%-14s %-4s %s", offset, step.Protocol, step.RemoteAddr)
+			if step.Encoding != "" {
+				fmt.Fprintf(w, " %s=%d", step.Encoding, step.Port)
+			}
+			if step.LocalAddr != "" {
+				fmt.Fprintf(w, " с %s", step.LocalAddr)
+			}
+			if step.Delay > 0 {
+				fmt.Fprintf(w, " (пауза %s)", formatOffset(step.Delay))
+			}
+			if step.RawFlags != "" {
+				fmt.Fprintf(w, " raw %s", step.RawFlags)
+			}
+			if step.Payload != "" {
+				fmt.Fprintf(w, " payload %q", step.Payload)
+			}
+			fmt.Fprintln(w)
+		}
+		if plan.Verify != "" {
+			fmt.Fprintf(w, "  затем проверка %s\n", plan.Verify)
+		}
+		if plan.Retries > 0 {
+			fmt.Fprintf(w, "  при неудаче повтор до %d раз\n", plan.Retries)
+		}
+		if plan.Exec != "" {
+			fmt.Fprintf(w, "  затем exec: %s\n", plan.Exec)
+		}
+	}
+}
+
+// formatOffset записывает смещение шага: 0ms, 500ms, 1.5s
+func formatOffset(d time.Duration) string {
+	if d == 0 {
+		return "0ms"
+	}
+	return d.Round(time.Millisecond).String()
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// minDialTimeout - минимальный таймаут TCP dial шага
+const minDialTimeout = 100 * time.Millisecond
+
+// PortSpec описывает шаг последовательности. В YAML записывается числом (7000),
+// строкой с протоколом ("8000/udp") или структурой ({port: 8000, protocol: udp, delay: 5s})
+type PortSpec struct {
+	Port       int       `yaml:"port"`
+	Protocol   string    `yaml:"protocol,omitempty"`    // tcp, udp или icmp; пусто - протокол цели
+	Delay      *Duration `yaml:"delay,omitempty"`       // пауза перед этим шагом вместо delay цели
+	Payload    string    `yaml:"payload,omitempty"`     // содержимое пакета вместо payload цели
+	SourcePort int       `yaml:"source_port,omitempty"` // порт источника вместо source_port цели
+}
+
+// portSpecFields - поля PortSpec в виде структуры без собственного UnmarshalYAML
+type portSpecFields PortSpec
+
+func (p *PortSpec) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		number, protocol, hasProtocol := strings.Cut(value.Value, "/")
+		port, err := strconv.Atoi(strings.TrimSpace(number))
+		if err != nil || hasProtocol && strings.TrimSpace(protocol) == "" {
+			return &yaml.TypeError{Errors: []string{
+				fmt.Sprintf("line %d: неверный порт '%s', ожидается 7000, \"7000/udp\" или {port: 7000, protocol: udp}", value.Line, value.Value),
+			}}
+		}
+		p.Port = port
+		p.Protocol = strings.ToLower(strings.TrimSpace(protocol))
+		return nil
+	case yaml.MappingNode:
+		if err := checkKnownKeys(value, portSpecFields{}); err != nil {
+			return err
+		}
+		var fields portSpecFields
+		if err := value.Decode(&fields); err != nil {
+			return err
+		}
+		*p = PortSpec(fields)
+		p.Protocol = strings.ToLower(p.Protocol)
+		return nil
+	default:
+		return &yaml.TypeError{Errors: []string{
+			fmt.Sprintf("line %d: неверный порт, ожидается число, строка или структура", value.Line),
+		}}
+	}
+}
+
+// MarshalYAML записывает шаг в короткой форме (7000 или "7000/udp"), если у него нет других параметров
+func (p PortSpec) MarshalYAML() (any, error) {
+	if p.Delay != nil || p.Payload != "" || p.SourcePort != 0 {
+		return portSpecFields(p), nil
+	}
+	if p.Protocol == "" {
+		return p.Port, nil
+	}
+	return p.String(), nil
+}
+
+// String возвращает шаг в виде "7000" или "7000/udp"
+func (p PortSpec) String() string {
+	if p.Protocol == "" {
+		return strconv.Itoa(p.Port)
+	}
+	return strconv.Itoa(p.Port) + "/" + p.Protocol
+}
+
+// portSpecs превращает номера портов в шаги с протоколом цели
+func portSpecs(ports []int) []PortSpec {
+	specs := make([]PortSpec, len(ports))
+	for i, port := range ports {
+		specs[i] = PortSpec{Port: port}
+	}
+	return specs
+}
+
+// PortNumbers возвращает номера портов последовательности
+func (t Target) PortNumbers() []int {
+	ports := make([]int, len(t.Ports))
+	for i, spec := range t.Ports {
+		ports[i] = spec.Port
+	}
+	return ports
+}
+
+// stepProtocol возвращает протокол шага: собственный или протокол цели
+func (t Target) stepProtocol(spec PortSpec) string {
+	if spec.Protocol != "" {
+		return strings.ToLower(spec.Protocol)
+	}
+	return strings.ToLower(t.Protocol)
+}
+
+// DisplayProtocol возвращает протокол цели для сообщений и шаблонов; если у шагов разные
+// протоколы - их список ("udp+tcp"), даже когда protocol цели задан для части шагов
+func (t Target) DisplayProtocol() string {
+	if len(t.Ports) == 0 {
+		return strings.ToLower(t.Protocol)
+	}
+	var protocols []string
+	for _, step := range t.steps() {
+		if !slices.Contains(protocols, step.Protocol) {
+			protocols = append(protocols, step.Protocol)
+		}
+	}
+	return strings.Join(protocols, "+")
+}
+
+// steps возвращает шаги последовательности с подставленным протоколом цели
+func (t Target) steps() []PortSpec {
+	steps := make([]PortSpec, len(t.Ports))
+	for i, spec := range t.Ports {
+		spec.Protocol = t.stepProtocol(spec)
+		steps[i] = spec
+	}
+	return steps
+}
+
+// stepPayload возвращает payload шага: собственный или payload цели
+func (t Target) stepPayload(spec PortSpec) string {
+	if spec.Payload != "" {
+		return spec.Payload
+	}
+	return t.Payload
+}
+
+// stepDelay возвращает паузу перед шагом i без разброса: delay шага или delay цели.
+// Перед первым шагом пауза делается, только если у него задан собственный delay
+func (t Target) stepDelay(i int) time.Duration {
+	if delay := t.Ports[i].Delay; delay != nil {
+		return time.Duration(*delay)
+	}
+	if i == 0 {
+		return 0
+	}
+	return time.Duration(t.Delay)
+}
+
+// dialTimeout возвращает таймаут dial шага i: половину паузы перед следующим шагом (для последнего -
+// половину delay цели), но не меньше 100ms. Так стук в фильтруемый порт не сдвигает следующий шаг
+func (t Target) dialTimeout(i int) time.Duration {
+	next := time.Duration(t.Delay)
+	if i+1 < len(t.Ports) {
+		next = t.stepDelay(i + 1)
+	}
+	if timeout := next / 2; timeout > minDialTimeout {
+		return timeout
+	}
+	return minDialTimeout
+}
+
+// hasPause сообщает, делается ли пауза перед шагом i (к ней применяется jitter)
+func (t Target) hasPause(i int) bool {
+	return i > 0 || t.Ports[i].Delay != nil
+}
+
+// withJitter добавляет к паузе случайный разброс в пределах ±jitter, не уходя ниже нуля
+func withJitter(d, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	d += time.Duration(rand.Int63n(int64(2*jitter)+1)) - jitter
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// checkKnownKeys возвращает ошибку для ключей YAML структуры, которых нет среди yaml тегов v.
+// Нужна там, где node.Decode не наследует строгий режим декодера
+func checkKnownKeys(value *yaml.Node, v any) error {
+	known := make(map[string]bool)
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("yaml"), ",")
+		known[name] = true
+	}
+
+	var errs []string
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		key := value.Content[i]
+		if !known[key.Value] {
+			errs = append(errs, fmt.Sprintf("line %d: неизвестный параметр '%s'", key.Line, key.Value))
+		}
+	}
+	if len(errs) > 0 {
+		return &yaml.TypeError{Errors: errs}
+	}
+	return nil
+}
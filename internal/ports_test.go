@@ -0,0 +1,23 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDialTimeout(t *testing.T) {
+	short := Duration(100 * time.Millisecond)
+	long := Duration(3 * time.Second)
+	target := Target{
+		Delay: Duration(2 * time.Second),
+		Ports: []PortSpec{{Port: 7000}, {Port: 7001, Delay: &short}, {Port: 7002, Delay: &long}, {Port: 7003}},
+	}
+
+	// Таймаут шага зависит от паузы перед следующим шагом, а не от delay цели
+	want := []time.Duration{minDialTimeout, 1500 * time.Millisecond, time.Second, time.Second}
+	for i, w := range want {
+		if got := target.dialTimeout(i); got != w {
+			t.Errorf("dialTimeout(%d) = %v, ожидается %v", i, got, w)
+		}
+	}
+}
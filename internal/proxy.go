@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// TargetsForHost возвращает цели, относящиеся к хосту: совпадает host цели или host из verify
+func (c *Config) TargetsForHost(host string) []Target {
+	var targets []Target
+	for _, target := range c.Targets {
+		if strings.EqualFold(target.Host, host) || target.Verify != nil && strings.EqualFold(target.Verify.Host, host) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// Relay копирует данные между соединением и парой in/out (например, stdin/stdout для ProxyCommand),
+// пока сервер не закроет соединение. Конец in передается серверу как половинное закрытие
+func Relay(conn net.Conn, in io.Reader, out io.Writer) error {
+	upstream := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, in)
+		if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		}
+		upstream <- err
+	}()
+
+	_, err := io.Copy(out, conn)
+	conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	// Если сервер закрыл соединение первым, stdin может так и не закончиться - не ждем его
+	select {
+	case err := <-upstream:
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	default:
+	}
+	return nil
+}
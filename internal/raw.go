@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	defaultRawTTL   = 64
+	defaultRawFlags = "S"
+)
+
+// errRawUnavailable означает, что raw сокеты не поддерживаются платформой или нет прав (CAP_NET_RAW)
+var errRawUnavailable = errors.New("raw сокеты недоступны")
+
+// RawOptions включает отправку TCP knock через raw сокет: ровно один сегмент без handshake
+// и без повторных SYN. Работает на Linux с CAP_NET_RAW, иначе используется обычный dial
+type RawOptions struct {
+	TTL   int    `yaml:"ttl,omitempty"`   // TTL/hop limit (по умолчанию 64)
+	Flags string `yaml:"flags,omitempty"` // TCP флаги из букв FSRPAUEC (по умолчанию S - SYN)
+}
+
+func (o *RawOptions) ttl() int {
+	if o.TTL == 0 {
+		return defaultRawTTL
+	}
+	return o.TTL
+}
+
+// tcpFlags переводит буквы флагов в байт флагов TCP
+func (o *RawOptions) tcpFlags() (byte, error) {
+	letters := o.Flags
+	if letters == "" {
+		letters = defaultRawFlags
+	}
+	var flags byte
+	for _, letter := range strings.ToUpper(letters) {
+		bit := strings.IndexRune("FSRPAUEC", letter)
+		if bit < 0 {
+			return 0, fmt.Errorf("неизвестный TCP флаг '%c', ожидаются буквы FSRPAUEC", letter)
+		}
+		flags |= 1 << bit
+	}
+	return flags, nil
+}
+
+func (o *RawOptions) validate() error {
+	if o.TTL < 0 || o.TTL > 255 {
+		return fmt.Errorf("ttl %d вне допустимого диапазона (1-255)", o.TTL)
+	}
+	_, err := o.tcpFlags()
+	return err
+}
+
+// sendRawTCP отправляет один TCP сегмент через raw сокет. Ответ сервера не ожидается:
+// ядро само ответит RST на SYN-ACK, так как сокета для этого соединения нет
+func sendRawTCP(ctx context.Context, packet knockPacket, result *PacketResult) error {
+	opts := packet.Raw
+	flags, err := opts.tcpFlags()
+	if err != nil {
+		return err
+	}
+
+	remote, err := net.DefaultResolver.LookupIPAddr(ctx, packet.Host)
+	if err != nil {
+		return err
+	}
+	dst := remote[0].IP
+	if ip4 := dst.To4(); ip4 != nil {
+		dst = ip4
+	}
+
+	src, err := sourceIP(ctx, dst, packet.Source)
+	if err != nil {
+		return err
+	}
+
+	srcPort := packet.Source.Port
+	if srcPort == 0 {
+		srcPort = ephemeralPort()
+	}
+
+	result.LocalAddr = net.JoinHostPort(src.String(), fmt.Sprint(srcPort))
+	result.RemoteAddr = net.JoinHostPort(dst.String(), fmt.Sprint(packet.Port))
+
+	segment := tcpSegment(src, dst, srcPort, packet.Port, flags, packet.Payload)
+	return writeRawTCP(src, dst, segment, opts.ttl(), packet.Source.Interface)
+}
+
+// tcpSegment собирает TCP заголовок (без опций) с payload и контрольной суммой
+func tcpSegment(src, dst net.IP, srcPort, dstPort int, flags byte, payload []byte) []byte {
+	segment := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:], uint16(srcPort))
+	binary.BigEndian.PutUint16(segment[2:], uint16(dstPort))
+	binary.BigEndian.PutUint32(segment[4:], randomUint32()) // sequence number
+	if flags&0x10 != 0 {
+		binary.BigEndian.PutUint32(segment[8:], randomUint32()) // acknowledgment number для флага A
+	}
+	segment[12] = 5 << 4 // data offset: 5 слов по 32 бита
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:], 64240) // window
+	copy(segment[20:], payload)
+
+	binary.BigEndian.PutUint16(segment[16:], tcpChecksum(src, dst, segment))
+	return segment
+}
+
+// tcpChecksum считает контрольную сумму TCP с псевдозаголовком IPv4 или IPv6
+func tcpChecksum(src, dst net.IP, segment []byte) uint16 {
+	return transportChecksum(src, dst, 6, segment)
+}
+
+// transportChecksum считает контрольную сумму сегмента протокола proto (TCP, UDP, ICMPv6)
+// с псевдозаголовком IPv4 или IPv6
+func transportChecksum(src, dst net.IP, proto byte, segment []byte) uint16 {
+	var pseudo []byte
+	if src.To4() != nil {
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], src.To4())
+		copy(pseudo[4:], dst.To4())
+		pseudo[9] = proto
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(segment)))
+	} else {
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], src.To16())
+		copy(pseudo[16:], dst.To16())
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(segment)))
+		pseudo[39] = proto
+	}
+	return internetChecksum(pseudo, segment)
+}
+
+// internetChecksum считает контрольную сумму RFC 1071 по частям пакета, идущим подряд
+func internetChecksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, data := range parts {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(data[i:]))
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func randomUint32() uint32 {
+	var buf [4]byte
+	crand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}
@@ -0,0 +1,47 @@
+//go:build linux
+
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// writeRawTCP отправляет готовый TCP сегмент; IP заголовок с адресом src добавляет ядро
+func writeRawTCP(src, dst net.IP, segment []byte, ttl int, device string) error {
+	network, level, option := "ip4:tcp", syscall.IPPROTO_IP, syscall.IP_TTL
+	if src.To4() == nil {
+		network, level, option = "ip6:tcp", syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+
+	conn, err := net.ListenPacket(network, src.String())
+	if err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+			return fmt.Errorf("%w: %v", errRawUnavailable, err)
+		}
+		return err
+	}
+	defer conn.Close()
+
+	rawConn, err := conn.(*net.IPConn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), level, option, ttl)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("не удалось установить TTL: %w", sockErr)
+	}
+	if err := bindDevice(rawConn, device); err != nil {
+		return err
+	}
+
+	_, err = conn.WriteTo(segment, &net.IPAddr{IP: dst})
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package internal
+
+import "net"
+
+// writeRawTCP на других платформах не поддерживается: используется обычный dial
+func writeRawTCP(src, dst net.IP, segment []byte, ttl int, device string) error {
+	return errRawUnavailable
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pseudoHeader собирает псевдозаголовок для проверки контрольной суммы TCP
+func pseudoHeader(src, dst net.IP, length int) []byte {
+	if src.To4() != nil {
+		pseudo := make([]byte, 12)
+		copy(pseudo, src.To4())
+		copy(pseudo[4:], dst.To4())
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(length))
+		return pseudo
+	}
+	pseudo := make([]byte, 40)
+	copy(pseudo, src.To16())
+	copy(pseudo[16:], dst.To16())
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(length))
+	pseudo[39] = 6
+	return pseudo
+}
+
+func TestTCPSegment(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.IP
+		payload  []byte
+	}{
+		{name: "IPv4", src: net.ParseIP("192.0.2.1").To4(), dst: net.ParseIP("198.51.100.7").To4()},
+		{name: "IPv4 с нечетным payload", src: net.ParseIP("192.0.2.1").To4(), dst: net.ParseIP("198.51.100.7").To4(), payload: []byte("knock")},
+		{name: "IPv6", src: net.ParseIP("2001:db8::1"), dst: net.ParseIP("2001:db8::2")},
+		{name: "IPv6 с payload", src: net.ParseIP("2001:db8::1"), dst: net.ParseIP("2001:db8::2"), payload: []byte("open sesame")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segment := tcpSegment(tt.src, tt.dst, 40000, 7000, tcpFlagSYN, tt.payload)
+
+			if len(segment) != 20+len(tt.payload) {
+				t.Fatalf("длина сегмента %d, ожидается %d", len(segment), 20+len(tt.payload))
+			}
+			if port := binary.BigEndian.Uint16(segment[0:]); port != 40000 {
+				t.Errorf("порт источника %d", port)
+			}
+			if port := binary.BigEndian.Uint16(segment[2:]); port != 7000 {
+				t.Errorf("порт назначения %d", port)
+			}
+			if segment[12] != 5<<4 || segment[13] != tcpFlagSYN {
+				t.Errorf("data offset %#x, флаги %#x", segment[12], segment[13])
+			}
+			if !bytes.Equal(segment[20:], tt.payload) {
+				t.Errorf("payload %q", segment[20:])
+			}
+
+			// Сумма с верной контрольной суммой в заголовке дает ноль
+			if sum := internetChecksum(pseudoHeader(tt.src, tt.dst, len(segment)), segment); sum != 0 {
+				t.Errorf("контрольная сумма неверна: остаток %#04x", sum)
+			}
+			zeroed := bytes.Clone(segment)
+			zeroed[16], zeroed[17] = 0, 0
+			if got, want := binary.BigEndian.Uint16(segment[16:]), tcpChecksum(tt.src, tt.dst, zeroed); got != want {
+				t.Errorf("в сегменте контрольная сумма %#04x, tcpChecksum %#04x", got, want)
+			}
+		})
+	}
+}
+
+func TestTCPChecksumDependsOnAddresses(t *testing.T) {
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	segment := tcpSegment(src, dst, 40000, 7000, tcpFlagSYN, nil)
+	if sum := internetChecksum(pseudoHeader(src, net.ParseIP("2001:db8::3"), len(segment)), segment); sum == 0 {
+		t.Error("сегмент проходит проверку с чужим адресом назначения")
+	}
+}
+
+func TestRawTCPFlags(t *testing.T) {
+	tests := []struct {
+		flags   string
+		want    byte
+		wantErr bool
+	}{
+		{flags: "", want: tcpFlagSYN},
+		{flags: "S", want: 0x02},
+		{flags: "SA", want: 0x12},
+		{flags: "fpu", want: 0x29},
+		{flags: "SEC", want: 0xc2},
+		{flags: "SX", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flags, func(t *testing.T) {
+			got, err := (&RawOptions{Flags: tt.flags}).tcpFlags()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ожидается ошибка, получено %#x", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("флаги %#x, ожидается %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRawLoopback отправляет сегмент на loopback и читает его raw сокетом ip4:tcp (нужен root)
+func TestRawLoopback(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("нужен Linux и root")
+	}
+
+	listener, err := net.ListenPacket("ip4:tcp", "127.0.0.1")
+	if err != nil {
+		t.Skipf("raw сокет недоступен: %v", err)
+	}
+	defer listener.Close()
+
+	const port = 7
+	payload := []byte("knock")
+	packet := knockPacket{Host: "127.0.0.1", Port: port, Protocol: "tcp", Raw: &RawOptions{Flags: "S"}, Payload: payload}
+	var result PacketResult
+	if err := sendRawTCP(context.Background(), packet, &result); err != nil {
+		t.Fatal(err)
+	}
+	_, localPort, _ := net.SplitHostPort(result.LocalAddr)
+
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("сегмент не получен: %v", err)
+		}
+		segment := buf[:n] // IPv4 заголовок ip4 сокет отбрасывает
+		if len(segment) < 20 || binary.BigEndian.Uint16(segment[2:]) != port {
+			continue // например RST ядра в ответ
+		}
+
+		if got := strconv.Itoa(int(binary.BigEndian.Uint16(segment[0:]))); got != localPort {
+			t.Errorf("порт источника %s, в результате %s", got, result.LocalAddr)
+		}
+		if segment[13] != tcpFlagSYN {
+			t.Errorf("флаги %#x, ожидается SYN", segment[13])
+		}
+		if !bytes.Equal(segment[20:], payload) {
+			t.Errorf("payload %q, ожидается %q", segment[20:], payload)
+		}
+		loopback := net.ParseIP("127.0.0.1").To4()
+		if sum := internetChecksum(pseudoHeader(loopback, loopback, len(segment)), segment); sum != 0 {
+			t.Errorf("контрольная сумма неверна: остаток %#04x", sum)
+		}
+		return
+	}
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// PacketOutcome описывает результат отправки одного knock-пакета
+type PacketOutcome string
+
+const (
+	// OutcomeConnected - TCP соединение установлено
+	OutcomeConnected PacketOutcome = "connected"
+	// OutcomeSent - UDP датаграмма отправлена
+	OutcomeSent PacketOutcome = "sent"
+	// OutcomeRefused - хост ответил RST, SYN дошел до цели
+	OutcomeRefused PacketOutcome = "refused"
+	// OutcomeTimeout - ответа не было, SYN ушел в сеть
+	OutcomeTimeout PacketOutcome = "timeout"
+	// OutcomeFailed - пакет не был отправлен (ошибка разрешения имени, маршрута и т.п.)
+	OutcomeFailed PacketOutcome = "failed"
+)
+
+// Report содержит результаты выполнения port knocking по всем целям
+type Report struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Targets    []*TargetResult
+}
+
+// TargetResult содержит результаты knocking одной цели
+type TargetResult struct {
+	Name       string
+	Host       string
+	Protocol   string
+	Ports      []int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Packets    []PacketResult  // пакеты последней попытки
+	Verify     *VerifyResult   // результат проверки последней попытки (nil если verify не задан)
+	Attempts   []AttemptResult // все попытки последовательности, включая последнюю
+	Err        error           // ошибка, из-за которой цель считается неуспешной
+}
+
+// AttemptResult содержит результат одного прохода последовательности (см. retries)
+type AttemptResult struct {
+	Number     int
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Packets    []PacketResult
+	Verify     *VerifyResult
+	Err        error
+}
+
+// PacketResult содержит результат отправки одного пакета последовательности
+type PacketResult struct {
+	Port        int
+	Protocol    string
+	RemoteAddr  string // разрешенный адрес цели
+	LocalAddr   string // локальный адрес, с которого ушел пакет
+	StartedAt   time.Time
+	FinishedAt  time.Time
+	Outcome     PacketOutcome
+	PayloadSize int   // сколько байт payload отправлено
+	Raw         bool  // сегмент отправлен через raw сокет
+	Err         error // ошибка dial/записи; в режиме без ожидания соединения не прерывает последовательность
+}
+
+// Sent сообщает, ушел ли пакет в сеть
+func (p PacketResult) Sent() bool {
+	return p.Outcome != OutcomeFailed && p.Outcome != ""
+}
+
+// Failed возвращает цели, завершившиеся ошибкой
+func (r *Report) Failed() []*TargetResult {
+	var failed []*TargetResult
+	for _, target := range r.Targets {
+		if target.Err != nil {
+			failed = append(failed, target)
+		}
+	}
+	return failed
+}
+
+// WriteSummary выводит краткую сводку по всем отправленным пакетам
+func (r *Report) WriteSummary(w io.Writer) {
+	for _, target := range r.Targets {
+		status := "OK"
+		if target.Err != nil {
+			status = "ОШИБКА: " + target.Err.Error()
+		}
+		fmt.Fprintf(w, "%s%s (%s) за %v: %s\n", target.label(), target.Host, target.Protocol, target.FinishedAt.Sub(target.StartedAt).Round(time.Millisecond), status)
+
+		if len(target.Attempts) <= 1 {
+			writePackets(w, target.Packets, target.Verify, "  ")
+			continue
+		}
+		for _, attempt := range target.Attempts {
+			status := "OK"
+			if attempt.Err != nil {
+				status = "ОШИБКА: " + attempt.Err.Error()
+			}
+			fmt.Fprintf(w, "  попытка %d за %v: %s\n", attempt.Number, attempt.FinishedAt.Sub(attempt.StartedAt).Round(time.Millisecond), status)
+			writePackets(w, attempt.Packets, attempt.Verify, "    ")
+		}
+	}
+}
+
+// label возвращает префикс с именем цели ("name " или пустую строку)
+func (t *TargetResult) label() string {
+	if t.Name == "" {
+		return ""
+	}
+	return t.Name + " "
+}
+
+// writePackets выводит пакеты и результат проверки одной попытки
+func writePackets(w io.Writer, packets []PacketResult, verify *VerifyResult, indent string) {
+	for _, packet := range packets {
+		fmt.Fprintf(w, "%s%-5d %-4s %-9s", indent, packet.Port, packet.Protocol, packet.Outcome)
+		if packet.LocalAddr != "" || packet.RemoteAddr != "" {
+			fmt.Fprintf(w, " %s -> %s", packet.LocalAddr, packet.RemoteAddr)
+		}
+		if packet.Err != nil {
+			fmt.Fprintf(w, " (%v)", packet.Err)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if verify != nil {
+		if verify.Reachable {
+			fmt.Fprintf(w, "%sпроверка %s/%s: доступен", indent, verify.Address, verify.Protocol)
+			if verify.Banner != "" {
+				fmt.Fprintf(w, " (%s)", verify.Banner)
+			}
+		} else {
+			fmt.Fprintf(w, "%sпроверка %s/%s: недоступен после %d попыток", indent, verify.Address, verify.Protocol, verify.Attempts)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// classifyDialError определяет исход отправки по ошибке dial
+func classifyDialError(err error) PacketOutcome {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return OutcomeRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return OutcomeTimeout
+	default:
+		return OutcomeFailed
+	}
+}
+
+// fillAddrsFromError извлекает адреса из ошибки dial, если соединение не удалось
+func (p *PacketResult) fillAddrsFromError(err error) {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return
+	}
+	if opErr.Addr != nil && p.RemoteAddr == "" {
+		p.RemoteAddr = opErr.Addr.String()
+	}
+	if opErr.Source != nil && p.LocalAddr == "" {
+		p.LocalAddr = opErr.Source.String()
+	}
+}
@@ -0,0 +1,6 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package internal
+
+// soReusePort - SO_REUSEPORT, которого нет в пакете syscall для Linux
+const soReusePort = 0xf
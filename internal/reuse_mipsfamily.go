@@ -0,0 +1,6 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package internal
+
+// soReusePort - SO_REUSEPORT, на MIPS у него другое значение
+const soReusePort = 0x200
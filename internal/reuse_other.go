@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package internal
+
+// reusePort на других платформах не нужен: TCP соединения с заданным портом закрываются
+// без TIME_WAIT (linger 0)
+func reusePort(fd uintptr) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package internal
+
+import "syscall"
+
+// reusePort разрешает занять порт источника, который еще занят предыдущим стуком
+func reusePort(fd uintptr) error {
+	if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return err
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
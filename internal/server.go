@@ -0,0 +1,515 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSequenceTimeout = 10 * time.Second
+	progressSweepInterval  = time.Second // как часто удалять просроченные последовательности
+)
+
+// ServeOptions описывает серверную сторону цели для команды serve
+type ServeOptions struct {
+	SequenceTimeout Duration `yaml:"sequence_timeout,omitempty"` // за сколько нужно пройти всю последовательность (по умолчанию 10s)
+	Action          string   `yaml:"action,omitempty"`           // exec (по умолчанию), nftables или iptables
+	CloseAfter      Duration `yaml:"close_after,omitempty"`      // через сколько закрыть доступ (0 - не закрывать)
+
+	OpenCommand  string `yaml:"open_command,omitempty"`  // action: exec - команда открытия, {{.IP}} - адрес источника
+	CloseCommand string `yaml:"close_command,omitempty"` // action: exec - команда закрытия доступа
+
+	Nftables *NftablesOptions `yaml:"nftables,omitempty"` // action: nftables
+	Iptables *IptablesOptions `yaml:"iptables,omitempty"` // action: iptables
+}
+
+func (o *ServeOptions) actionName() string {
+	if o.Action == "" {
+		return ActionExec
+	}
+	return strings.ToLower(o.Action)
+}
+
+// ActionData - данные, доступные в шаблонах команд сервера
+type ActionData struct {
+	IP       string // адрес, с которого пришла последовательность
+	Host     string // host цели из конфигурации
+	Protocol string
+	Ports    []int // принятая последовательность
+}
+
+// KnockServer принимает knock последовательности, описанные в тех же целях, что использует клиент
+type KnockServer struct {
+	targets   []Target
+	listenIP  net.IP          // принимать только пакеты на этот адрес (nil - на любой)
+	protocols map[string]bool // протоколы шагов всех целей
+	rawFlags  map[byte]bool   // TCP флаги raw стука целей, кроме SYN
+	verbose   bool
+	out       io.Writer
+	outMu     sync.Mutex
+
+	actions   []FirewallAction // действие для каждой цели (nil - только журнал)
+	secrets   [][]byte         // секрет TOTP каждой цели (nil - постоянная последовательность)
+	runner    CommandRunner
+	afterFunc func(time.Duration, func()) closeTimer // планирует закрытие доступа (time.AfterFunc)
+
+	mu       sync.Mutex
+	progress map[progressKey]*knockProgress
+	closers  map[progressKey]closeTimer
+	used     map[progressKey]uint64 // последнее окно TOTP, принятое от источника: его и более ранние окна он повторить не может
+	swept    time.Time              // когда progress и used последний раз очищались от устаревших записей
+}
+
+// closeTimer - отложенное закрытие доступа: *time.Timer или управляемый таймер в тестах
+type closeTimer interface {
+	Stop() bool
+}
+
+type progressKey struct {
+	target int
+	ip     string
+}
+
+// knockProgress - сколько шагов последовательности уже прошел источник
+type knockProgress struct {
+	sequence knockSequence
+	next     int
+	started  time.Time
+}
+
+// knockSequence - последовательность, которую принимает цель
+type knockSequence struct {
+	steps  []sequenceStep
+	window uint64 // окно TOTP, из которого получены порты (0 для постоянной последовательности)
+}
+
+// sequenceStep - шаг последовательности.
+// Для icmp port - значение шага, а encoding - поле echo request, в котором оно передается
+type sequenceStep struct {
+	protocol string
+	port     int
+	encoding string
+}
+
+func (k sequenceStep) String() string {
+	if k.protocol == "icmp" {
+		return fmt.Sprintf("icmp %s=%d", k.encoding, k.port)
+	}
+	return fmt.Sprintf("%s/%d", k.protocol, k.port)
+}
+
+// NewKnockServer создает сервер для целей конфигурации. listen - локальный адрес (пусто - все адреса)
+func NewKnockServer(config *Config, listen string) (*KnockServer, error) {
+	s := &KnockServer{
+		protocols: make(map[string]bool),
+		rawFlags:  make(map[byte]bool),
+		out:       os.Stdout,
+		progress:  make(map[progressKey]*knockProgress),
+		closers:   make(map[progressKey]closeTimer),
+		used:      make(map[progressKey]uint64),
+		runner:    ExecRunner{},
+		afterFunc: func(d time.Duration, f func()) closeTimer { return time.AfterFunc(d, f) },
+	}
+
+	if listen != "" {
+		s.listenIP = net.ParseIP(listen)
+		if s.listenIP == nil {
+			return nil, fmt.Errorf("неверный адрес для прослушивания: %s", listen)
+		}
+		if s.listenIP.IsUnspecified() {
+			s.listenIP = nil
+		}
+	}
+
+	for _, target := range config.Targets {
+		target.Protocol = strings.ToLower(target.Protocol)
+		if !serverProtocols(target) {
+			s.printf("Цель %s (%s) пропущена: сервер принимает только tcp, udp и icmp последовательности\n", target.Host, target.Protocol)
+			continue
+		}
+		if len(target.Ports) == 0 && target.TOTP == nil {
+			return nil, fmt.Errorf("у цели %s не указаны порты", target.Host)
+		}
+		// Секрет TOTP читается один раз: файл или переменная окружения не перечитываются на каждый пакет
+		var secret []byte
+		if target.TOTP != nil {
+			if err := target.TOTP.validate(); err != nil {
+				return nil, fmt.Errorf("цель %s: %w", target.Host, err)
+			}
+			var err error
+			if secret, err = target.TOTP.secret(); err != nil {
+				return nil, fmt.Errorf("цель %s: %w", target.Host, err)
+			}
+		}
+
+		var action FirewallAction
+		if target.Serve != nil {
+			var err error
+			action, err = NewFirewallAction(target.Serve, serverRunner{s})
+			if err != nil {
+				return nil, fmt.Errorf("цель %s: %w", target.Host, err)
+			}
+		}
+
+		if target.TOTP != nil || len(target.Ports) == 0 {
+			s.protocols[target.Protocol] = true
+		}
+		for _, step := range target.steps() {
+			s.protocols[step.Protocol] = true
+		}
+		if target.Raw != nil {
+			flags, err := target.Raw.tcpFlags()
+			if err != nil {
+				return nil, fmt.Errorf("цель %s: %w", target.Host, err)
+			}
+			if flags != tcpFlagSYN {
+				s.rawFlags[flags] = true
+			}
+		}
+
+		s.targets = append(s.targets, target)
+		s.actions = append(s.actions, action)
+		s.secrets = append(s.secrets, secret)
+	}
+
+	if len(s.targets) == 0 {
+		return nil, fmt.Errorf("в конфигурации нет целей, которые может принимать сервер")
+	}
+
+	return s, nil
+}
+
+// SetOutput задает, куда выводить журнал сервера (по умолчанию os.Stdout)
+func (s *KnockServer) SetOutput(w io.Writer) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	s.out = w
+}
+
+// SetVerbose включает вывод каждого принятого пакета
+func (s *KnockServer) SetVerbose(verbose bool) {
+	s.verbose = verbose
+}
+
+func (s *KnockServer) printf(format string, args ...any) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+	fmt.Fprintf(s.out, "%s "+format, append([]any{time.Now().Format(time.RFC3339)}, args...)...)
+}
+
+// Serve принимает последовательности всех целей до отмены контекста. Входящие пакеты
+// перехватываются сокетом захвата, поэтому порты последовательности не открываются и для
+// сканера выглядят как любые другие закрытые порты. При остановке выполняет отложенные
+// команды закрытия, чтобы не оставлять доступ открытым
+func (s *KnockServer) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	capture, err := listenCapture(s.ackKnocks())
+	if err != nil {
+		return err
+	}
+	s.printf("Сервер принимает последовательности %d целей\n", len(s.targets))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.readPackets(ctx, capture)
+	}()
+
+	select {
+	case <-ctx.Done():
+		capture.Close()
+		err = <-done
+	case err = <-done:
+		capture.Close()
+	}
+	s.closePending()
+	return err
+}
+
+// readPackets передает каждый пакет, который может быть стуком, в handleKnock
+func (s *KnockServer) readPackets(ctx context.Context, capture packetCapture) error {
+	buf := make([]byte, 65535)
+	for {
+		n, err := capture.ReadPacket(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("ошибка чтения пакетов: %w", err)
+		}
+
+		packet, ok := parseCaptured(buf[:n])
+		if !ok || !s.accepts(packet) {
+			continue
+		}
+		s.handleKnock(ctx, packet.src.String(), packet, time.Now())
+	}
+}
+
+// accepts отбирает пакеты, которые сервер считает стуком: на адрес -l, протокола одной из
+// целей, для TCP - попытки соединения (SYN без ACK) или сегменты с флагами raw стука цели
+func (s *KnockServer) accepts(packet capturedPacket) bool {
+	if s.listenIP != nil && !packet.dst.Equal(s.listenIP) {
+		return false
+	}
+	if !s.protocols[packet.protocol] {
+		return false
+	}
+	if packet.protocol == "tcp" {
+		return packet.flags&(tcpFlagSYN|tcpFlagACK) == tcpFlagSYN || s.rawFlags[packet.flags]
+	}
+	return true
+}
+
+// ackKnocks сообщает, что флаги raw стука какой-то цели содержат ACK
+func (s *KnockServer) ackKnocks() bool {
+	for flags := range s.rawFlags {
+		if flags&tcpFlagACK != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// handleKnock продвигает состояние последовательностей источника ip и выполняет действие,
+// если последовательность пройдена полностью. Пакет, который не является следующим шагом,
+// сбрасывает последовательность, поэтому перебор портов подряд ее не пройдет
+func (s *KnockServer) handleKnock(ctx context.Context, ip string, packet capturedPacket, at time.Time) {
+	var completed []int
+	s.mu.Lock()
+	if at.Sub(s.swept) >= progressSweepInterval {
+		s.sweep(at)
+	}
+	for i, target := range s.targets {
+		step := packet.step(target)
+		key := progressKey{target: i, ip: ip}
+		state := s.progress[key]
+		if state != nil && at.Sub(state.started) > sequenceTimeout(target) {
+			delete(s.progress, key)
+			state = nil
+		}
+
+		if state != nil {
+			switch step {
+			case state.sequence.steps[state.next]:
+				state.next++
+			case state.sequence.steps[state.next-1]:
+				// Повтор предыдущего шага (ретрансмиссия SYN) не сбрасывает последовательность
+				continue
+			default:
+				// Неверный пакет сбрасывает последовательность, но может начать новую
+				if s.verbose {
+					s.printf("Пакет %s от %s сбросил последовательность %s\n", step, ip, target.Host)
+				}
+				delete(s.progress, key)
+				state = nil
+			}
+		}
+
+		if state == nil {
+			for _, sequence := range s.candidateSequences(key, at) {
+				if sequence.steps[0] == step {
+					state = &knockProgress{sequence: sequence, next: 1, started: at}
+					s.progress[key] = state
+					break
+				}
+			}
+			if state == nil {
+				continue
+			}
+		}
+
+		if s.verbose {
+			s.printf("Пакет %s от %s: шаг %d из %d последовательности %s\n", step, ip, state.next, len(state.sequence.steps), target.Host)
+		}
+
+		if state.next == len(state.sequence.steps) {
+			delete(s.progress, key)
+			if target.TOTP != nil {
+				// Окно использовано: источник не может повторить его и более ранние окна
+				if used, ok := s.used[key]; ok && state.sequence.window <= used {
+					continue
+				}
+				s.used[key] = state.sequence.window
+			}
+			completed = append(completed, i)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, i := range completed {
+		s.accept(ctx, i, ip)
+	}
+}
+
+// sweep удаляет начатые последовательности старше sequence_timeout и отметки TOTP окон, которые
+// уже не принимаются. Без этого пакеты первого шага с множества (в том числе поддельных) адресов
+// копили бы записи без ограничения. Вызывается под s.mu
+func (s *KnockServer) sweep(at time.Time) {
+	s.swept = at
+	for key, state := range s.progress {
+		if at.Sub(state.started) > sequenceTimeout(s.targets[key.target]) {
+			delete(s.progress, key)
+		}
+	}
+	for key, used := range s.used {
+		// Принимаются окна не раньше предыдущего: более старая отметка уже ничего не запрещает
+		if used+1 < s.targets[key.target].TOTP.Window(at) {
+			delete(s.used, key)
+		}
+	}
+}
+
+// candidateSequences возвращает последовательности, которые сейчас принимает цель key.target от
+// источника key.ip. Для TOTP допускаются соседние окна, чтобы пережить расхождение часов и смену
+// окна во время стука, кроме уже использованных этим источником. Вызывается под s.mu
+func (s *KnockServer) candidateSequences(key progressKey, at time.Time) []knockSequence {
+	target := s.targets[key.target]
+	if target.TOTP == nil {
+		return []knockSequence{{steps: sequenceSteps(target)}}
+	}
+
+	secret := s.secrets[key.target]
+	window := target.TOTP.Window(at)
+	used, hasUsed := s.used[key]
+	var sequences []knockSequence
+	for _, w := range []uint64{window - 1, window, window + 1} {
+		if hasUsed && w <= used {
+			continue
+		}
+		target.Ports = portSpecs(DeriveTOTPPorts(secret, w, target.TOTP.length(), target.TOTP.PortMin, target.TOTP.PortMax))
+		sequences = append(sequences, knockSequence{steps: sequenceSteps(target), window: w})
+	}
+	return sequences
+}
+
+// accept выполняет действие цели i для источника ip
+func (s *KnockServer) accept(ctx context.Context, i int, ip string) {
+	target := s.targets[i]
+	s.printf("Принята последовательность %s от %s\n", target.Host, ip)
+
+	action := s.actions[i]
+	if action == nil {
+		return
+	}
+
+	data := ActionData{IP: ip, Host: target.Host, Protocol: target.DisplayProtocol(), Ports: target.PortNumbers()}
+	closeAfter := time.Duration(target.Serve.CloseAfter)
+	expiring, ok := action.(selfExpiringAction)
+	scheduled := closeAfter > 0 && !(ok && expiring.ExpiresItself())
+
+	// Повторная последовательность продлевает доступ. Пока закрытие запланировано, доступ уже
+	// открыт: Open не повторяется (иначе iptables вставит второе правило, а удалит одно),
+	// заменяется только таймер. Действия с таймаутом в ядре продлевают его сами в Open
+	key := progressKey{target: i, ip: ip}
+	s.mu.Lock()
+	timer := s.closers[key]
+	extend := scheduled && timer != nil && timer.Stop()
+	s.mu.Unlock()
+
+	if !extend {
+		if err := action.Open(ctx, data, closeAfter); err != nil {
+			s.printf("Ошибка открытия доступа для %s: %v\n", ip, err)
+			return
+		}
+	}
+	if !scheduled {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var closer closeTimer
+	closer = s.afterFunc(closeAfter, func() {
+		s.mu.Lock()
+		if s.closers[key] == closer {
+			delete(s.closers, key)
+		}
+		s.mu.Unlock()
+
+		if err := action.Close(context.Background(), data); err != nil {
+			s.printf("Ошибка закрытия доступа для %s: %v\n", ip, err)
+		}
+	})
+	s.closers[key] = closer
+}
+
+// closePending сразу закрывает доступ, закрытие которого было отложено
+func (s *KnockServer) closePending() {
+	s.mu.Lock()
+	pending := s.closers
+	s.closers = make(map[progressKey]closeTimer)
+	s.mu.Unlock()
+
+	for key, timer := range pending {
+		if !timer.Stop() {
+			continue // закрытие уже выполняется
+		}
+		target := s.targets[key.target]
+		data := ActionData{IP: key.ip, Host: target.Host, Protocol: target.DisplayProtocol(), Ports: target.PortNumbers()}
+		if err := s.actions[key.target].Close(context.Background(), data); err != nil {
+			s.printf("Ошибка закрытия доступа для %s: %v\n", key.ip, err)
+		}
+	}
+}
+
+// SetCommandRunner задает, как выполняются команды действий (например RecordingRunner в тестах)
+func (s *KnockServer) SetCommandRunner(runner CommandRunner) {
+	s.runner = runner
+}
+
+// serverRunner выводит выполняемые команды в журнал и передает их текущему CommandRunner сервера
+type serverRunner struct {
+	s *KnockServer
+}
+
+func (r serverRunner) Run(ctx context.Context, name string, args ...string) error {
+	if r.s.verbose {
+		r.s.printf("Выполнение: %s %s\n", name, strings.Join(args, " "))
+	}
+	return r.s.runner.Run(ctx, name, args...)
+}
+
+func sequenceTimeout(target Target) time.Duration {
+	if target.Serve != nil && target.Serve.SequenceTimeout > 0 {
+		return time.Duration(target.Serve.SequenceTimeout)
+	}
+	return defaultSequenceTimeout
+}
+
+// sequenceSteps возвращает шаги последовательности цели с протоколами
+func sequenceSteps(target Target) []sequenceStep {
+	var steps []sequenceStep
+	for _, step := range target.steps() {
+		key := sequenceStep{protocol: step.Protocol, port: step.Port}
+		if step.Protocol == "icmp" {
+			key.encoding = target.ICMP.encoding()
+		}
+		steps = append(steps, key)
+	}
+	return steps
+}
+
+// serverProtocols сообщает, что все шаги цели - tcp, udp или icmp
+func serverProtocols(target Target) bool {
+	supported := func(protocol string) bool {
+		return protocol == "tcp" || protocol == "udp" || protocol == "icmp"
+	}
+	if target.TOTP != nil || len(target.Ports) == 0 {
+		return supported(target.Protocol)
+	}
+	for _, step := range target.steps() {
+		if !supported(step.Protocol) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer создает сервер с одной tcp целью, команды которого только записываются
+func newTestServer(t *testing.T, ports ...int) (*KnockServer, *RecordingRunner) {
+	t.Helper()
+	config := &Config{Targets: []Target{{
+		Host:     "server.example.com",
+		Ports:    portSpecs(ports),
+		Protocol: "tcp",
+		Serve:    &ServeOptions{OpenCommand: "open {{.IP}}"},
+	}}}
+	server, err := NewKnockServer(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetOutput(io.Discard)
+	runner := &RecordingRunner{}
+	server.SetCommandRunner(runner)
+	return server, runner
+}
+
+func synPacket(port int) capturedPacket {
+	return capturedPacket{protocol: "tcp", port: port, flags: tcpFlagSYN}
+}
+
+func TestServerAcceptsSequence(t *testing.T) {
+	server, runner := newTestServer(t, 17000, 17500, 18000)
+	at := time.Now()
+	for _, port := range []int{17000, 17500, 17500, 18000} { // повтор шага - ретрансмиссия SYN
+		server.handleKnock(context.Background(), "192.0.2.1", synPacket(port), at)
+	}
+
+	commands := runner.Commands()
+	if len(commands) != 1 || commands[0][len(commands[0])-1] != "open 192.0.2.1" {
+		t.Fatalf("команды %v, ожидается одна команда open 192.0.2.1", commands)
+	}
+}
+
+func TestServerScanResetsSequence(t *testing.T) {
+	server, runner := newTestServer(t, 17000, 17500, 18000)
+	at := time.Now()
+	for port := 16990; port <= 18010; port++ {
+		server.handleKnock(context.Background(), "192.0.2.1", synPacket(port), at)
+	}
+	if commands := runner.Commands(); len(commands) != 0 {
+		t.Fatalf("перебор портов открыл доступ: %v", commands)
+	}
+
+	// Посторонний пакет другого источника не мешает последовательности
+	for _, port := range []int{17000, 17500, 18000} {
+		server.handleKnock(context.Background(), "192.0.2.1", synPacket(port), at)
+		server.handleKnock(context.Background(), "192.0.2.2", synPacket(22), at)
+	}
+	if commands := runner.Commands(); len(commands) != 1 {
+		t.Fatalf("команды %v, ожидается одна", commands)
+	}
+}
+
+func TestServerSequenceTimeout(t *testing.T) {
+	server, runner := newTestServer(t, 7000, 8000)
+	at := time.Now()
+	server.handleKnock(context.Background(), "192.0.2.1", synPacket(7000), at)
+	server.handleKnock(context.Background(), "192.0.2.1", synPacket(8000), at.Add(defaultSequenceTimeout+time.Second))
+	if commands := runner.Commands(); len(commands) != 0 {
+		t.Fatalf("просроченная последовательность принята: %v", commands)
+	}
+}
+
+func TestServerSweepsStaleProgress(t *testing.T) {
+	server, _ := newTestServer(t, 7000, 8000)
+	at := time.Now()
+	for i := 0; i < 1000; i++ {
+		ip := net.IPv4(198, 51, byte(i>>8), byte(i)).String()
+		server.handleKnock(context.Background(), ip, synPacket(7000), at)
+	}
+	if n := len(server.progress); n != 1000 {
+		t.Fatalf("начатых последовательностей %d, ожидается 1000", n)
+	}
+
+	// Пакет любого другого источника после sequence_timeout удаляет просроченные записи
+	server.handleKnock(context.Background(), "192.0.2.1", synPacket(22), at.Add(defaultSequenceTimeout+time.Second))
+	if n := len(server.progress); n != 0 {
+		t.Fatalf("после sequence_timeout осталось %d последовательностей", n)
+	}
+}
+
+func TestServerAcceptsFilter(t *testing.T) {
+	server, _ := newTestServer(t, 7000)
+
+	tests := []struct {
+		name   string
+		packet capturedPacket
+		want   bool
+	}{
+		{name: "SYN", packet: synPacket(7000), want: true},
+		{name: "SYN с ECN", packet: capturedPacket{protocol: "tcp", flags: tcpFlagSYN | 0xc0}, want: true},
+		{name: "SYN-ACK", packet: capturedPacket{protocol: "tcp", flags: tcpFlagSYN | tcpFlagACK}},
+		{name: "ACK", packet: capturedPacket{protocol: "tcp", flags: tcpFlagACK}},
+		{name: "UDP без udp шагов", packet: capturedPacket{protocol: "udp", port: 7000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := server.accepts(tt.packet); got != tt.want {
+				t.Errorf("accepts = %v, ожидается %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// ipv4Packet собирает IPv4 пакет без опций
+func ipv4Packet(src, dst net.IP, proto byte, payload []byte) []byte {
+	packet := make([]byte, 20+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = proto
+	copy(packet[12:], src.To4())
+	copy(packet[16:], dst.To4())
+	copy(packet[20:], payload)
+	return packet
+}
+
+// ipv6Packet собирает IPv6 пакет без заголовков расширений
+func ipv6Packet(src, dst net.IP, next byte, payload []byte) []byte {
+	packet := make([]byte, 40+len(payload))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:], uint16(len(payload)))
+	packet[6] = next
+	packet[7] = 64
+	copy(packet[8:], src.To16())
+	copy(packet[24:], dst.To16())
+	copy(packet[40:], payload)
+	return packet
+}
+
+func TestParseCaptured(t *testing.T) {
+	src4, dst4 := net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()
+	src6, dst6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], 40000)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+
+	fragment := ipv4Packet(src4, dst4, 6, tcpSegment(src4, dst4, 40000, 7000, tcpFlagSYN, nil))
+	binary.BigEndian.PutUint16(fragment[6:], 10) // смещение фрагмента
+
+	tests := []struct {
+		name     string
+		data     []byte
+		ok       bool
+		protocol string
+		port     int
+		src      net.IP
+	}{
+		{
+			name: "IPv4 SYN", ok: true, protocol: "tcp", port: 7000, src: src4,
+			data: ipv4Packet(src4, dst4, 6, tcpSegment(src4, dst4, 40000, 7000, tcpFlagSYN, nil)),
+		},
+		{
+			name: "IPv6 SYN", ok: true, protocol: "tcp", port: 8000, src: src6,
+			data: ipv6Packet(src6, dst6, 6, tcpSegment(src6, dst6, 40000, 8000, tcpFlagSYN, nil)),
+		},
+		{
+			name: "IPv6 UDP", ok: true, protocol: "udp", port: 53, src: src6,
+			data: ipv6Packet(src6, dst6, 17, udp),
+		},
+		{
+			name: "ICMP echo", ok: true, protocol: "icmp", src: src4,
+			data: ipv4Packet(src4, dst4, 1, newICMPEcho(ICMPEncodeSeq, 9000, nil).marshal(false)),
+		},
+		{name: "фрагмент", data: fragment},
+		{name: "GRE", data: ipv4Packet(src4, dst4, 47, make([]byte, 8))},
+		{name: "короткий", data: []byte{0x45, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet, ok := parseCaptured(tt.data)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, ожидается %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if packet.protocol != tt.protocol || packet.port != tt.port || !packet.src.Equal(tt.src) {
+				t.Errorf("разобрано %s/%d от %s, ожидается %s/%d от %s", packet.protocol, packet.port, packet.src, tt.protocol, tt.port, tt.src)
+			}
+		})
+	}
+}
+
+func TestServerTOTPReplay(t *testing.T) {
+	const secret = "test-secret"
+	totp := &TOTPOptions{Secret: secret, PortMin: 10000, PortMax: 20000}
+	config := &Config{Targets: []Target{{
+		Host:     "server.example.com",
+		Protocol: "tcp",
+		TOTP:     totp,
+		Serve:    &ServeOptions{OpenCommand: "open {{.IP}}"},
+	}}}
+	server, err := NewKnockServer(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetOutput(io.Discard)
+	runner := &RecordingRunner{}
+	server.SetCommandRunner(runner)
+
+	at := time.Unix(1_700_000_000, 0)
+	window := totp.Window(at)
+	knock := func(ip string, window uint64) {
+		for _, port := range DeriveTOTPPorts([]byte(secret), window, defaultTOTPLength, totp.PortMin, totp.PortMax) {
+			server.handleKnock(context.Background(), ip, synPacket(port), at)
+		}
+	}
+	opened := func() []string {
+		var ips []string
+		for _, command := range runner.Commands() {
+			ips = append(ips, command[len(command)-1])
+		}
+		return ips
+	}
+
+	knock("192.0.2.1", window)
+	knock("192.0.2.2", window) // другой клиент в том же окне принимается
+	knock("192.0.2.1", window) // повтор окна тем же источником отклоняется
+	if got := opened(); len(got) != 2 || got[0] != "open 192.0.2.1" || got[1] != "open 192.0.2.2" {
+		t.Fatalf("команды %v, ожидается open для 192.0.2.1 и 192.0.2.2", got)
+	}
+
+	knock("192.0.2.2", window+1)
+	knock("192.0.2.2", window-1) // окно раньше использованного
+	knock("192.0.2.3", window-1) // для нового источника предыдущее окно еще допустимо
+	if got := opened(); len(got) != 4 || got[2] != "open 192.0.2.2" || got[3] != "open 192.0.2.3" {
+		t.Fatalf("команды %v, ожидается еще open для 192.0.2.2 (окно +1) и 192.0.2.3", got)
+	}
+
+	// Через несколько окон отметки больше ничего не запрещают и удаляются
+	server.handleKnock(context.Background(), "192.0.2.9", synPacket(22), at.Add(3*totp.period()))
+	if n := len(server.used); n != 0 {
+		t.Fatalf("осталось %d отметок использованных окон", n)
+	}
+}
+
+func TestServerTOTPSecretLoadedOnce(t *testing.T) {
+	t.Setenv(TOTPSecretEnvVar, "env-secret")
+	totp := &TOTPOptions{PortMin: 10000, PortMax: 20000}
+	config := &Config{Targets: []Target{{Host: "server.example.com", Protocol: "tcp", TOTP: totp, Serve: &ServeOptions{OpenCommand: "open {{.IP}}"}}}}
+	server, err := NewKnockServer(config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetOutput(io.Discard)
+	runner := &RecordingRunner{}
+	server.SetCommandRunner(runner)
+
+	// Секрет прочитан при создании сервера: смена переменной окружения не меняет последовательность
+	t.Setenv(TOTPSecretEnvVar, "other-secret")
+	at := time.Unix(1_700_000_000, 0)
+	for _, port := range DeriveTOTPPorts([]byte("env-secret"), totp.Window(at), defaultTOTPLength, totp.PortMin, totp.PortMax) {
+		server.handleKnock(context.Background(), "192.0.2.1", synPacket(port), at)
+	}
+	if commands := runner.Commands(); len(commands) != 1 {
+		t.Fatalf("команды %v, ожидается одна", commands)
+	}
+}
@@ -0,0 +1,342 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// sourceBinding описывает, откуда уходят пакеты цели
+type sourceBinding struct {
+	IP        net.IP // адрес источника (nil - по таблице маршрутизации)
+	Port      int    // порт источника (0 - любой)
+	Interface string // интерфейс, к которому привязывается сокет (пусто - любой)
+	Gateway   net.IP // следующий узел в сети Interface (nil - по таблице маршрутизации)
+}
+
+// source определяет адрес источника и интерфейс отправки по source_address, source_port, gateway
+// и interface. Пакеты через шлюз уходят с интерфейса, в сети которого находится шлюз, на его
+// адрес канального уровня. Шлюз, совпадающий с локальным адресом, - прежняя форма source_address
+// (gateway: "IP" или "IP:порт")
+func (t Target) source() (sourceBinding, error) {
+	binding := sourceBinding{Port: t.SourcePort}
+	if t.SourceAddress != "" {
+		binding.IP = net.ParseIP(t.SourceAddress)
+		if binding.IP == nil {
+			return binding, fmt.Errorf("неверный source_address '%s', ожидается IP", t.SourceAddress)
+		}
+	}
+	if t.Gateway != "" {
+		if err := binding.viaGateway(t.Gateway); err != nil {
+			return binding, err
+		}
+	}
+	if t.Interface == "" {
+		return binding, nil
+	}
+
+	iface, err := net.InterfaceByName(t.Interface)
+	if err != nil {
+		return binding, fmt.Errorf("интерфейс %s не найден: %w", t.Interface, err)
+	}
+	if binding.Interface != "" && binding.Interface != iface.Name {
+		return binding, fmt.Errorf("шлюз %s находится в сети интерфейса %s, а не %s", t.Gateway, binding.Interface, iface.Name)
+	}
+	binding.Interface = iface.Name
+	if binding.IP == nil && !canBindToDevice {
+		// Без привязки к интерфейсу направляем пакеты через него адресом источника
+		if binding.IP, err = interfaceAddr(iface); err != nil {
+			return binding, err
+		}
+	}
+	return binding, nil
+}
+
+// viaGateway настраивает отправку через шлюз gateway
+func (b *sourceBinding) viaGateway(gateway string) error {
+	ip, port, err := parseGateway(gateway)
+	if err != nil {
+		return err
+	}
+	iface, addr, local, err := gatewayInterface(ip)
+	if err != nil {
+		return err
+	}
+
+	if local {
+		if b.IP == nil {
+			b.IP = ip
+		}
+		if b.Port == 0 {
+			b.Port = port
+		}
+		return nil
+	}
+	if port != 0 {
+		return fmt.Errorf("у шлюза %s не указывается порт: порт источника задается source_port", gateway)
+	}
+	b.Interface, b.Gateway = iface, ip
+	if b.IP == nil {
+		b.IP = addr
+	}
+	if (b.IP.To4() == nil) != (ip.To4() == nil) {
+		return fmt.Errorf("адрес источника %s и шлюз %s разных версий IP", b.IP, ip)
+	}
+	return nil
+}
+
+// interfaceAddr возвращает адрес интерфейса: IPv4, если он есть, иначе IPv6 (кроме link-local)
+func interfaceAddr(iface *net.Interface) (net.IP, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("не удалось получить адреса интерфейса %s: %w", iface.Name, err)
+	}
+	var found net.IP
+	for _, a := range addrs {
+		network, ok := a.(*net.IPNet)
+		if !ok || network.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if network.IP.To4() != nil {
+			return network.IP, nil
+		}
+		if found == nil {
+			found = network.IP
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("у интерфейса %s нет адреса", iface.Name)
+	}
+	return found, nil
+}
+
+// parseGateway разбирает шлюз в форме IP или IP:порт
+func parseGateway(gateway string) (net.IP, int, error) {
+	if ip := net.ParseIP(gateway); ip != nil {
+		return ip, 0, nil
+	}
+	host, portStr, err := net.SplitHostPort(gateway)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		return nil, 0, fmt.Errorf("неверный адрес шлюза '%s', ожидается IP или IP:порт", gateway)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, 0, fmt.Errorf("неверный порт шлюза '%s'", gateway)
+	}
+	return ip, port, nil
+}
+
+// gatewayInterface находит интерфейс, в сети которого находится шлюз, и адрес интерфейса в этой сети.
+// local - шлюз совпадает с адресом одного из интерфейсов
+func gatewayInterface(gateway net.IP) (iface string, addr net.IP, local bool, err error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, false, fmt.Errorf("не удалось получить список интерфейсов: %w", err)
+	}
+	for _, candidate := range interfaces {
+		addrs, err := candidate.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			network, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if network.IP.Equal(gateway) {
+				return candidate.Name, network.IP, true, nil
+			}
+			if iface == "" && network.Contains(gateway) {
+				iface, addr = candidate.Name, network.IP
+			}
+		}
+	}
+	if iface == "" {
+		return "", nil, false, fmt.Errorf("шлюз %s не находится в сети ни одного локального интерфейса", gateway)
+	}
+	return iface, addr, false, nil
+}
+
+// localAddr возвращает адрес источника в виде, который ожидает dialer протокола (nil - любой)
+func (b sourceBinding) localAddr(protocol string) net.Addr {
+	if b.IP == nil && b.Port == 0 {
+		return nil
+	}
+	if protocol == "udp" {
+		return &net.UDPAddr{IP: b.IP, Port: b.Port}
+	}
+	return &net.TCPAddr{IP: b.IP, Port: b.Port}
+}
+
+// dialer создает dialer с адресом источника и привязкой к интерфейсу. Заданный порт источника
+// открывается с SO_REUSEADDR/SO_REUSEPORT, чтобы частые стуки с одного порта не получали
+// "address already in use"
+func (b sourceBinding) dialer(protocol string, timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		LocalAddr: b.localAddr(protocol),
+		Timeout:   timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := bindDevice(c, b.Interface); err != nil {
+				return err
+			}
+			if b.Port == 0 {
+				return nil
+			}
+			var reuseErr error
+			if err := c.Control(func(fd uintptr) {
+				reuseErr = reusePort(fd)
+			}); err != nil {
+				return err
+			}
+			return reuseErr
+		},
+	}
+}
+
+// boundDialer создает dialer, который сам привязывает сокет к адресу источника в Control и
+// записывает занятый адрес в bound еще до connect: при отказе или таймауте соединения адреса
+// источника нет в ошибке dial. Незаданный адрес источника берется из таблицы маршрутизации
+func (b sourceBinding) boundDialer(protocol string, timeout time.Duration, bound *net.Addr) *net.Dialer {
+	d := b.dialer(protocol, timeout)
+	if !canBindLocal {
+		return d
+	}
+	d.LocalAddr = nil
+	control := d.Control
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		if err := control(network, address, c); err != nil {
+			return err
+		}
+		var ip net.IP
+		var port int
+		var bindErr error
+		if err := c.Control(func(fd uintptr) {
+			ip, port, bindErr = bindLocal(fd, network, b.IP, b.Port)
+		}); err != nil {
+			return err
+		}
+		if bindErr != nil {
+			return bindErr
+		}
+
+		if ip.IsUnspecified() {
+			host, _, _ := net.SplitHostPort(address)
+			if src, err := sourceIP(context.Background(), net.ParseIP(host), b); err == nil {
+				ip = src
+			}
+		}
+		*bound = sourceBinding{IP: ip, Port: port}.localAddr(protocol)
+		return nil
+	}
+	return d
+}
+
+// ephemeralPort выбирает случайный порт из диапазона эфемерных портов Linux
+func ephemeralPort() int {
+	return 32768 + int(randomUint32()%28232)
+}
+
+// String описывает источник для сообщений: "192.168.1.5 через eth0" или
+// "10.8.0.2 через шлюз 10.8.0.1 (tun0)"
+func (b sourceBinding) String() string {
+	address := "любой адрес"
+	if b.IP != nil {
+		address = b.IP.String()
+	}
+	if b.Port != 0 {
+		address = net.JoinHostPort(address, strconv.Itoa(b.Port))
+	}
+	switch {
+	case b.Gateway != nil:
+		address += fmt.Sprintf(" через шлюз %s (%s)", b.Gateway, b.Interface)
+	case b.Interface != "":
+		address += " через " + b.Interface
+	}
+	return address
+}
+
+// sourceIP определяет адрес источника для пакетов к dst: заданный или выбранный по таблице
+// маршрутизации (connect UDP сокета только выбирает маршрут и ничего не отправляет)
+func sourceIP(ctx context.Context, dst net.IP, source sourceBinding) (net.IP, error) {
+	if source.IP != nil {
+		if ip4 := source.IP.To4(); ip4 != nil {
+			return ip4, nil
+		}
+		return source.IP, nil
+	}
+	conn, err := sourceBinding{Interface: source.Interface}.dialer("udp", 0).DialContext(ctx, "udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return nil, fmt.Errorf("не удалось определить адрес источника: %w", err)
+	}
+	defer conn.Close()
+	src := conn.LocalAddr().(*net.UDPAddr).IP
+	if ip4 := src.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return src, nil
+}
+
+// bindDevice привязывает сокет к интерфейсу device (пусто - без привязки)
+func bindDevice(c syscall.RawConn, device string) error {
+	if device == "" {
+		return nil
+	}
+	var bindErr error
+	if err := c.Control(func(fd uintptr) {
+		bindErr = bindToDevice(fd, device)
+	}); err != nil {
+		return err
+	}
+	return bindErr
+}
+
+// ipVersion возвращает версию IP адресов цели: "4", "6" или пустую строку для любой
+func (t Target) ipVersion() string {
+	switch strings.ToLower(t.IPVersion) {
+	case "4", "ipv4":
+		return "4"
+	case "6", "ipv6":
+		return "6"
+	default:
+		return ""
+	}
+}
+
+// network добавляет к сети версию IP цели: "tcp" -> "tcp6"
+func (t Target) network(protocol string) string {
+	return protocol + t.ipVersion()
+}
+
+// resolveHost возвращает адреса хоста для knocking: все адреса нужной версии IP. Заданный
+// адрес источника оставляет только адреса своей версии
+func resolveHost(ctx context.Context, host, version string, source net.IP) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось разрешить %s: %w", host, err)
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ip := addr.IP
+		v4 := ip.To4() != nil
+		if version == "4" && !v4 || version == "6" && v4 || source != nil && (source.To4() != nil) != v4 {
+			continue
+		}
+		if v4 {
+			ip = ip.To4()
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		if source != nil {
+			return nil, fmt.Errorf("у %s нет адресов той же версии IP, что и адрес источника %s", host, source)
+		}
+		return nil, fmt.Errorf("у %s нет адресов IPv%s", host, version)
+	}
+	return ips, nil
+}
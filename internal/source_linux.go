@@ -0,0 +1,20 @@
+//go:build linux
+
+package internal
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// canBindToDevice - сокет можно привязать к интерфейсу
+const canBindToDevice = true
+
+// bindToDevice привязывает сокет к интерфейсу (SO_BINDTODEVICE): маршрут выбирается только
+// среди маршрутов этого интерфейса
+func bindToDevice(fd uintptr, device string) error {
+	if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device); err != nil {
+		return fmt.Errorf("не удалось привязать сокет к интерфейсу %s: %w", device, err)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package internal
+
+// canBindToDevice - сокет можно привязать к интерфейсу
+const canBindToDevice = false
+
+// bindToDevice на других платформах ничего не делает: интерфейс выбирается адресом источника
+func bindToDevice(fd uintptr, device string) error {
+	return nil
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// knockLoopback стучит в один порт цели без пауз и возвращает ее результат
+func knockLoopback(t *testing.T, target Target) *TargetResult {
+	t.Helper()
+	pk := NewPortKnocker()
+	pk.SetOutput(io.Discard)
+	result, err := pk.KnockTargetContext(context.Background(), target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// TestSourceLoopbackAlias проверяет адрес и порт источника на адресах 127.0.0.0/8, которые
+// в Linux все принадлежат lo
+func TestSourceLoopbackAlias(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("адреса 127.0.0.0/8 кроме 127.0.0.1 есть на lo только в Linux")
+	}
+
+	t.Run("udp source_address", func(t *testing.T) {
+		listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		port := listener.LocalAddr().(*net.UDPAddr).Port
+
+		knockLoopback(t, Target{Host: "127.0.0.1", Ports: portSpecs([]int{port}), Protocol: "udp", SourceAddress: "127.0.0.2"})
+
+		listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, from, err := listener.ReadFrom(make([]byte, 16))
+		if err != nil {
+			t.Fatalf("датаграмма не получена: %v", err)
+		}
+		if ip := from.(*net.UDPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+			t.Errorf("датаграмма от %s, ожидается 127.0.0.2", ip)
+		}
+	})
+
+	t.Run("tcp source_address и source_port", func(t *testing.T) {
+		listener, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		port := listener.Addr().(*net.TCPAddr).Port
+		sourcePort := freePort(t, "127.0.0.3")
+
+		knockLoopback(t, Target{Host: "127.0.0.1", Ports: portSpecs([]int{port}), Protocol: "tcp", SourceAddress: "127.0.0.3", SourcePort: sourcePort})
+
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("соединение не получено: %v", err)
+		}
+		defer conn.Close()
+		if got, want := conn.RemoteAddr().String(), net.JoinHostPort("127.0.0.3", strconv.Itoa(sourcePort)); got != want {
+			t.Errorf("соединение от %s, ожидается %s", got, want)
+		}
+	})
+
+	t.Run("прежняя форма gateway", func(t *testing.T) {
+		listener, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		port := listener.LocalAddr().(*net.UDPAddr).Port
+		sourcePort := freePort(t, "127.0.0.1")
+
+		gateway := net.JoinHostPort("127.0.0.1", strconv.Itoa(sourcePort))
+		knockLoopback(t, Target{Host: "127.0.0.1", Ports: portSpecs([]int{port}), Protocol: "udp", Gateway: gateway})
+
+		listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, from, err := listener.ReadFrom(make([]byte, 16))
+		if err != nil {
+			t.Fatalf("датаграмма не получена: %v", err)
+		}
+		if from.String() != gateway {
+			t.Errorf("датаграмма от %s, ожидается %s", from, gateway)
+		}
+	})
+}
+
+// freePort возвращает свободный TCP порт на адресе ip
+func freePort(t *testing.T, ip string) int {
+	t.Helper()
+	listener, err := net.Listen("tcp4", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestSourceGateway(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("адреса 127.0.0.0/8 кроме 127.0.0.1 есть на lo только в Linux")
+	}
+
+	// 127.0.0.9 не назначен ни одному интерфейсу, но находится в сети lo: это следующий узел
+	source, err := Target{Gateway: "127.0.0.9"}.source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !source.Gateway.Equal(net.ParseIP("127.0.0.9")) || source.Interface != "lo" || !source.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("источник %s, ожидается 127.0.0.1 через шлюз 127.0.0.9 (lo)", source)
+	}
+
+	// Локальный адрес - прежняя форма source_address, шлюза нет
+	source, err = Target{Gateway: "127.0.0.1:40000"}.source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.Gateway != nil || source.Interface != "" || source.Port != 40000 {
+		t.Errorf("источник %s, ожидается 127.0.0.1:40000", source)
+	}
+
+	if _, err := (Target{Gateway: "127.0.0.9:40000"}).source(); err == nil {
+		t.Error("порт у нелокального шлюза принят")
+	}
+}
+
+// TestRefusedKnockLocalAddr проверяет, что у отклоненного TCP стука есть адрес источника
+func TestRefusedKnockLocalAddr(t *testing.T) {
+	if !canBindLocal {
+		t.Skip("адрес источника до connect определяется только в Unix")
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		want   string // ожидаемый адрес источника без порта
+	}{
+		{name: "адрес по таблице маршрутизации", want: "127.0.0.1"},
+		{name: "source_address", source: "127.0.0.1", want: "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t, "127.0.0.1") // порт уже закрыт: соединение будет отклонено
+			pk := NewPortKnocker()
+			pk.SetOutput(io.Discard)
+			result, _ := pk.KnockTargetContext(context.Background(), Target{Host: "127.0.0.1", Ports: portSpecs([]int{port}), Protocol: "tcp", SourceAddress: tt.source}, false)
+			if len(result.Packets) != 1 || result.Packets[0].Outcome != OutcomeRefused {
+				t.Fatalf("пакеты %+v, ожидается один отклоненный", result.Packets)
+			}
+
+			host, localPort, err := net.SplitHostPort(result.Packets[0].LocalAddr)
+			if err != nil {
+				t.Fatalf("адрес источника %q: %v", result.Packets[0].LocalAddr, err)
+			}
+			if host != tt.want || localPort == "0" {
+				t.Errorf("адрес источника %s, ожидается %s с эфемерным портом", result.Packets[0].LocalAddr, tt.want)
+			}
+		})
+	}
+}
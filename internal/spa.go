@@ -0,0 +1,299 @@
+package internal
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultSPAPort - стандартный UDP порт fwknopd
+	DefaultSPAPort = 62201
+
+	// Системные переменные для ключей SPA, если они не заданы в конфигурации
+	SPAKeyEnvVar     = "PORT_KNOCKER_SPA_KEY"
+	SPAHMACKeyEnvVar = "PORT_KNOCKER_SPA_HMAC_KEY"
+
+	spaProtocolVersion        = "3.0.0" // версия протокола fwknop
+	spaAccessMsg              = 1       // FKO_ACCESS_MSG
+	spaClientTimeoutAccessMsg = 3       // FKO_CLIENT_TIMEOUT_ACCESS_MSG
+	spaSaltedPrefix           = "Salted__"
+	spaSaltedPrefixB64        = "U2FsdGVkX1" // base64 от "Salted__", fwknop не передает его в пакете
+	spaMaxKeyLen              = 32
+	spaMaxHMACKeyLen          = 128
+)
+
+// SPAOptions описывает параметры Single Packet Authorization в формате fwknop
+type SPAOptions struct {
+	Key           string `yaml:"key,omitempty"`            // ключ Rijndael (KEY в access.conf); префикс base64: для KEY_BASE64
+	KeyFile       string `yaml:"key_file,omitempty"`       // файл с ключом Rijndael
+	HMACKey       string `yaml:"hmac_key,omitempty"`       // ключ HMAC-SHA256 (HMAC_KEY); префикс base64: для HMAC_KEY_BASE64
+	HMACKeyFile   string `yaml:"hmac_key_file,omitempty"`  // файл с ключом HMAC
+	Access        string `yaml:"access"`                   // запрашиваемый доступ, например "tcp/22" или "tcp/22,udp/53"
+	AllowIP       string `yaml:"allow_ip,omitempty"`       // IP для открытия; по умолчанию локальный адрес, "0.0.0.0" - адрес источника пакета
+	Username      string `yaml:"username,omitempty"`       // имя пользователя в сообщении; по умолчанию текущий пользователь
+	ClientTimeout int    `yaml:"client_timeout,omitempty"` // сколько секунд держать доступ открытым (0 - по настройке сервера)
+}
+
+// keys загружает ключ шифрования и ключ HMAC тем же способом, что и ключ конфигурации:
+// из значения в конфигурации, из файла или из системной переменной
+func (o *SPAOptions) keys() (encKey, hmacKey []byte, err error) {
+	encKey, err = loadKey(o.Key, o.KeyFile, SPAKeyEnvVar)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ключ SPA: %w", err)
+	}
+	if len(encKey) > spaMaxKeyLen {
+		return nil, nil, fmt.Errorf("ключ SPA длиннее %d байт", spaMaxKeyLen)
+	}
+
+	hmacKey, err = loadKey(o.HMACKey, o.HMACKeyFile, SPAHMACKeyEnvVar)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ключ HMAC SPA: %w", err)
+	}
+	if len(hmacKey) > spaMaxHMACKeyLen {
+		return nil, nil, fmt.Errorf("ключ HMAC SPA длиннее %d байт", spaMaxHMACKeyLen)
+	}
+
+	return encKey, hmacKey, nil
+}
+
+// knockSPA отправляет один зашифрованный и подписанный SPA пакет fwknop
+func (pk *PortKnocker) knockSPA(ctx context.Context, target Target, verbose bool, result *TargetResult) error {
+	if target.SPA == nil {
+		return fmt.Errorf("для protocol: spa требуется блок spa")
+	}
+	if target.SPA.Access == "" {
+		return fmt.Errorf("в блоке spa не указан access (например tcp/22)")
+	}
+
+	port := DefaultSPAPort
+	switch len(target.Ports) {
+	case 0:
+	case 1:
+		port = target.Ports[0].Port
+	default:
+		return fmt.Errorf("SPA отправляется одним пакетом, ожидается не больше одного порта, указано %d", len(target.Ports))
+	}
+	result.Ports = []int{port}
+
+	encKey, hmacKey, err := target.SPA.keys()
+	if err != nil {
+		return err
+	}
+
+	source, err := target.source()
+	if err != nil {
+		return err
+	}
+
+	packet := PacketResult{
+		Port:      port,
+		Protocol:  "spa",
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		packet.FinishedAt = time.Now()
+		result.Packets = append(result.Packets, packet)
+	}()
+
+	// Через шлюз пакет собирается целиком, как и шаги стука, и уходит с адреса источника
+	address := net.JoinHostPort(target.Host, strconv.Itoa(port))
+	localIP := source.IP
+	var conn net.Conn
+	if source.Gateway == nil {
+		conn, err = source.dialer("udp", 0).DialContext(ctx, target.network("udp"), address)
+		if err != nil {
+			packet.fillAddrsFromError(err)
+			packet.Outcome = OutcomeFailed
+			packet.Err = err
+			return fmt.Errorf("не удалось отправить SPA пакет: %w", err)
+		}
+		defer conn.Close()
+
+		packet.RemoteAddr = conn.RemoteAddr().String()
+		packet.LocalAddr = conn.LocalAddr().String()
+		localIP = conn.LocalAddr().(*net.UDPAddr).IP
+	}
+
+	// По умолчанию просим открыть доступ для адреса, с которого уходит пакет
+	allowIP := target.SPA.AllowIP
+	if allowIP == "" {
+		allowIP = localIP.String()
+	}
+
+	username := target.SPA.Username
+	if username == "" {
+		username = currentUsername()
+	}
+
+	var data string
+	random, salt, err := spaNonce()
+	if err == nil {
+		data, err = encodeSPA(spaMessage{
+			Random:        random,
+			Username:      username,
+			Timestamp:     time.Now(),
+			Access:        allowIP + "," + target.SPA.Access,
+			ClientTimeout: target.SPA.ClientTimeout,
+		}, salt, encKey, hmacKey)
+	}
+	if err != nil {
+		packet.Outcome = OutcomeFailed
+		packet.Err = err
+		return fmt.Errorf("не удалось сформировать SPA пакет: %w", err)
+	}
+
+	if verbose {
+		pk.printf("  Отправка SPA пакета на %s (доступ %s,%s)\n", address, allowIP, target.SPA.Access)
+	}
+
+	if conn == nil {
+		err = sendSPAViaGateway(ctx, target, port, source, []byte(data), &packet)
+	} else {
+		_, err = conn.Write([]byte(data))
+	}
+	if err != nil {
+		packet.Outcome = OutcomeFailed
+		packet.Err = err
+		return fmt.Errorf("не удалось отправить SPA пакет: %w", err)
+	}
+
+	packet.Outcome = OutcomeSent
+	return nil
+}
+
+// sendSPAViaGateway отправляет SPA датаграмму через шлюз на первый адрес хоста версии источника
+func sendSPAViaGateway(ctx context.Context, target Target, port int, source sourceBinding, data []byte, packet *PacketResult) error {
+	addrs, err := resolveHost(ctx, target.Host, target.ipVersion(), source.IP)
+	if err != nil {
+		return err
+	}
+	request := knockPacket{Host: addrs[0].String(), Port: port, Protocol: "udp", Source: source, Payload: data}
+	return sendViaGateway(ctx, request, packet)
+}
+
+// currentUsername возвращает имя пользователя для поля username сообщения fwknop
+func currentUsername() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+	return "port-knocker"
+}
+
+// spaMessage - поля сообщения доступа fwknop
+type spaMessage struct {
+	Random        uint64 // 16 десятичных цифр
+	Username      string
+	Timestamp     time.Time
+	Access        string // "ip,proto/port[,proto/port...]"
+	ClientTimeout int
+}
+
+// spaNonce возвращает случайное значение сообщения (16 цифр) и 8 байт соли шифрования
+func spaNonce() (uint64, []byte, error) {
+	random, err := crand.Int(crand.Reader, big.NewInt(1e16))
+	if err != nil {
+		return 0, nil, fmt.Errorf("не удалось получить случайное значение: %w", err)
+	}
+	salt := make([]byte, 8)
+	if _, err := crand.Read(salt); err != nil {
+		return 0, nil, fmt.Errorf("не удалось создать соль: %w", err)
+	}
+	return random.Uint64(), salt, nil
+}
+
+// encodeSPA собирает SPA пакет в формате fwknop:
+// rand:user:timestamp:version:type:access[:timeout]:digest, зашифрованный Rijndael (AES-256-CBC)
+// с солью OpenSSL, в base64 без префикса "U2FsdGVkX1", с добавленным в конец HMAC-SHA256
+func encodeSPA(msg spaMessage, salt, encKey, hmacKey []byte) (string, error) {
+	msgType := spaAccessMsg
+	if msg.ClientTimeout > 0 {
+		msgType = spaClientTimeoutAccessMsg
+	}
+
+	fields := []string{
+		fmt.Sprintf("%016d", msg.Random),
+		spaB64([]byte(msg.Username)),
+		strconv.FormatInt(msg.Timestamp.Unix(), 10),
+		spaProtocolVersion,
+		strconv.Itoa(msgType),
+		spaB64([]byte(msg.Access)),
+	}
+	if msg.ClientTimeout > 0 {
+		fields = append(fields, strconv.Itoa(msg.ClientTimeout))
+	}
+	encoded := strings.Join(fields, ":")
+
+	digest := sha256.Sum256([]byte(encoded))
+	plaintext := encoded + ":" + spaB64(digest[:])
+
+	ciphertext, err := spaEncrypt([]byte(plaintext), encKey, salt)
+	if err != nil {
+		return "", err
+	}
+	encrypted := strings.TrimPrefix(spaB64(ciphertext), spaSaltedPrefixB64)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(encrypted))
+
+	return encrypted + spaB64(mac.Sum(nil)), nil
+}
+
+// spaEncrypt шифрует данные как fwknop: AES-256-CBC, ключ и IV из пароля и соли через MD5 (EVP_BytesToKey)
+func spaEncrypt(plaintext, passphrase, salt []byte) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("соль должна быть 8 байт, получено %d", len(salt))
+	}
+
+	// Ключ (32 байта) и IV (16 байт) получаем цепочкой MD5(prev + пароль + соль)
+	var keyIV, prev []byte
+	for len(keyIV) < 48 {
+		h := md5.New()
+		h.Write(prev)
+		h.Write(passphrase)
+		h.Write(salt)
+		prev = h.Sum(nil)
+		keyIV = append(keyIV, prev...)
+	}
+
+	block, err := aes.NewCipher(keyIV[:32])
+	if err != nil {
+		return nil, fmt.Errorf("не удалось создать AES cipher: %w", err)
+	}
+
+	// Дополнение PKCS#7 до размера блока
+	padLen := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := append([]byte{}, plaintext...)
+	for i := 0; i < padLen; i++ {
+		padded = append(padded, byte(padLen))
+	}
+
+	out := make([]byte, 0, len(spaSaltedPrefix)+len(salt)+len(padded))
+	out = append(out, spaSaltedPrefix...)
+	out = append(out, salt...)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, keyIV[32:48]).CryptBlocks(ciphertext, padded)
+
+	return append(out, ciphertext...), nil
+}
+
+// spaB64 кодирует в base64 без завершающих '=' как это делает fwknop
+func spaB64(data []byte) string {
+	return strings.TrimRight(base64.StdEncoding.EncodeToString(data), "=")
+}
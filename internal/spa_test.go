@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Ожидаемые пакеты получены независимо от кода пакета, средствами OpenSSL, как их собирает fwknop
+// (msg - поля сообщения, salt - соль в hex). С явной солью openssl enc не пишет заголовок
+// "Salted__", поэтому он добавляется вручную; "openssl enc -d -md md5" расшифровывает результат:
+//
+//	b64() { printf %s "$1" | base64 -w0 | tr -d =; }
+//	digest=$(printf %s "$msg" | openssl dgst -sha256 -binary | base64 -w0 | tr -d =)
+//	enc=$({ printf Salted__; printf %s "$salt" | xxd -r -p; printf %s "$msg:$digest" | \
+//		openssl enc -aes-256-cbc -md md5 -S "$salt" -pass pass:rijndael-key; } | \
+//		base64 -w0 | tr -d = | sed 's/^U2FsdGVkX1//')
+//	mac=$(printf %s "$enc" | openssl dgst -sha256 -hmac hmac-key-for-spa -binary | base64 -w0 | tr -d =)
+//	echo "$enc$mac"
+func TestEncodeSPA(t *testing.T) {
+	encKey := []byte("rijndael-key")
+	hmacKey := []byte("hmac-key-for-spa")
+
+	tests := []struct {
+		name    string
+		random  uint64
+		salt    []byte
+		timeout int
+		want    string
+	}{
+		{
+			// msg="1234567890123456:$(b64 alice):1700000000:3.0.0:1:$(b64 192.0.2.10,tcp/22)" salt=0102030405060708
+			name:   "access",
+			random: 1234567890123456,
+			salt:   []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			want: "8BAgMEBQYHCAypP3GZYHpfiYjCdSTsrEvw+TDqmmEn16j9yvMHxVtvTC3DD8WwY8WMMUIbL21eF5QSfAuGz3HFRnAO" +
+				"JSsI9iJolwRE3nVSemTrM6a/CowVFlKSIy0qcBiapt+PX6HoSzuLR7ia8hwC/tB0J6Lqdewty7rmDQAx1gxedu/cEr" +
+				"9X6QK1Gm8fbhl5R+gycoglG0",
+		},
+		{
+			// msg="0000000000004242:$(b64 alice):1700000000:3.0.0:3:$(b64 192.0.2.10,tcp/22):30" salt=a1b2c3d4e5f60718
+			name:    "client_timeout",
+			random:  4242,
+			salt:    []byte{0xa1, 0xb2, 0xc3, 0xd4, 0xe5, 0xf6, 0x07, 0x18},
+			timeout: 30,
+			want: "+hssPU5fYHGLWtd59wkmjnKnfWX6P+wHfwKz5YdFVVMSsGzy/dfLhk0F/T4mjqD1g7jPW+siiqvbiPENylaLVevFlU" +
+				"LhG+f5X8eq2NrvvpTGf1ufIsl0cujPy6ChUXnBroKc5qBKiHn00GTHkPV0Ny68PyW3tUpiYyu5FynZQMsURiAzFO9o" +
+				"5a2gxwNEqvKsmtfQV+PORcxlEzGJdFeB8FwLal4WFreN0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet, err := encodeSPA(spaMessage{
+				Random:        tt.random,
+				Username:      "alice",
+				Timestamp:     time.Unix(1700000000, 0),
+				Access:        "192.0.2.10,tcp/22",
+				ClientTimeout: tt.timeout,
+			}, tt.salt, encKey, hmacKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packet != tt.want {
+				t.Errorf("пакет\n%s\nожидается\n%s", packet, tt.want)
+			}
+		})
+	}
+}
+
+func TestSPAEncryptSalt(t *testing.T) {
+	if _, err := spaEncrypt([]byte("data"), []byte("key"), []byte("short")); err == nil {
+		t.Error("соль короче 8 байт принята")
+	}
+}
+
+func TestSPANonce(t *testing.T) {
+	random1, salt1, err := spaNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	random2, salt2, err := spaNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if random1 >= 1e16 || random2 >= 1e16 {
+		t.Errorf("случайное значение больше 16 цифр: %d, %d", random1, random2)
+	}
+	if len(salt1) != 8 || len(salt2) != 8 {
+		t.Fatalf("длина соли %d и %d, ожидается 8", len(salt1), len(salt2))
+	}
+	if random1 == random2 && bytes.Equal(salt1, salt2) {
+		t.Error("два вызова вернули одинаковые значения")
+	}
+}
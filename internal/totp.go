@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// TOTPSecretEnvVar - системная переменная с секретом TOTP, если он не задан в конфигурации
+	TOTPSecretEnvVar = "PORT_KNOCKER_TOTP_SECRET"
+
+	defaultTOTPLength = 3
+	defaultTOTPPeriod = 30 * time.Second
+	maxTOTPLength     = 16 // номер шага занимает в сообщении HMAC один байт
+)
+
+// TOTPOptions описывает последовательность, порты которой меняются каждые period.
+// Порт шага i для окна counter = unix_time / period:
+//
+//	mac  = HMAC-SHA256(secret, counter (8 байт big-endian) || i (1 байт))
+//	code = big-endian uint32 из mac[mac[31]&0x0f:] & 0x7fffffff (усечение как в RFC 4226)
+//	port = port_min + code % (port_max - port_min + 1)
+//
+// Если порт совпадает с предыдущим, берется следующий по кругу в диапазоне
+type TOTPOptions struct {
+	Secret     string   `yaml:"secret,omitempty"`      // общий секрет (префиксы base32: и base64:)
+	SecretFile string   `yaml:"secret_file,omitempty"` // файл с секретом
+	PortMin    int      `yaml:"port_min"`              // нижняя граница диапазона портов
+	PortMax    int      `yaml:"port_max"`              // верхняя граница диапазона портов
+	Length     int      `yaml:"length,omitempty"`      // количество портов в последовательности (по умолчанию 3)
+	Period     Duration `yaml:"period,omitempty"`      // длительность окна (по умолчанию 30s)
+}
+
+// Ports возвращает последовательность портов для окна, в которое попадает t, и номер этого окна
+func (o *TOTPOptions) Ports(t time.Time) ([]int, uint64, error) {
+	secret, err := o.secret()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := o.validate(); err != nil {
+		return nil, 0, err
+	}
+
+	window := o.Window(t)
+	return DeriveTOTPPorts(secret, window, o.length(), o.PortMin, o.PortMax), window, nil
+}
+
+// Window возвращает номер временного окна для момента t
+func (o *TOTPOptions) Window(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(o.period()/time.Second)
+}
+
+// DeriveTOTPPorts вычисляет последовательность портов для окна window.
+// Серверная сторона должна использовать ту же функцию, допуская соседние окна
+func DeriveTOTPPorts(secret []byte, window uint64, length, portMin, portMax int) []int {
+	span := uint32(portMax - portMin + 1)
+	msg := make([]byte, 9)
+	binary.BigEndian.PutUint64(msg, window)
+
+	ports := make([]int, 0, length)
+	for i := 0; i < length; i++ {
+		msg[8] = byte(i)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(msg)
+		sum := mac.Sum(nil)
+
+		offset := sum[len(sum)-1] & 0x0f
+		code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+		port := portMin + int(code%span)
+
+		// Одинаковые соседние порты сервер не отличит от повтора пакета
+		if i > 0 && port == ports[i-1] && span > 1 {
+			port = portMin + (port-portMin+1)%int(span)
+		}
+		ports = append(ports, port)
+	}
+
+	return ports
+}
+
+func (o *TOTPOptions) secret() ([]byte, error) {
+	secret, err := loadKey(o.Secret, o.SecretFile, TOTPSecretEnvVar)
+	if err != nil {
+		return nil, fmt.Errorf("секрет TOTP: %w", err)
+	}
+	return secret, nil
+}
+
+func (o *TOTPOptions) validate() error {
+	if o.PortMin < 1 || o.PortMax > 65535 || o.PortMin >= o.PortMax {
+		return fmt.Errorf("неверный диапазон портов TOTP %d-%d, ожидается 1 <= port_min < port_max <= 65535", o.PortMin, o.PortMax)
+	}
+	if o.Length < 0 || o.Length > maxTOTPLength {
+		return fmt.Errorf("длина TOTP последовательности %d вне допустимого диапазона (1-%d)", o.Length, maxTOTPLength)
+	}
+	// Окно считается в целых секундах unix времени: 1500ms работали бы как 1s
+	if period := time.Duration(o.Period); period != 0 && (period < time.Second || period%time.Second != 0) {
+		return fmt.Errorf("период TOTP задается целым числом секунд (не меньше 1s), указано %v", period)
+	}
+	return nil
+}
+
+func (o *TOTPOptions) length() int {
+	if o.Length == 0 {
+		return defaultTOTPLength
+	}
+	return o.Length
+}
+
+func (o *TOTPOptions) period() time.Duration {
+	if o.Period == 0 {
+		return defaultTOTPPeriod
+	}
+	return time.Duration(o.Period)
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Ожидаемые порты посчитаны независимо (Python hmac) по формуле из описания TOTPOptions
+func TestDeriveTOTPPorts(t *testing.T) {
+	secret := []byte("12345678901234567890") // секрет тестовых векторов RFC 4226/6238
+
+	tests := []struct {
+		name             string
+		window           uint64
+		length           int
+		portMin, portMax int
+		want             []int
+	}{
+		{name: "окно 0", window: 0, length: 3, portMin: 10000, portMax: 20000, want: []int{12929, 10812, 11608}},
+		{name: "окно 56666666", window: 56666666, length: 4, portMin: 1024, portMax: 65535, want: []int{41237, 3413, 21852, 61061}},
+		{name: "повтор соседнего порта сдвигается", window: 0, length: 4, portMin: 7000, portMax: 7001, want: []int{7000, 7001, 7000, 7001}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DeriveTOTPPorts(secret, tt.window, tt.length, tt.portMin, tt.portMax)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("порты %v, ожидается %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTOTPWindow(t *testing.T) {
+	tests := []struct {
+		period Duration
+		at     time.Time
+		want   uint64
+	}{
+		{at: time.Unix(1_700_000_000, 0), want: 56666666},
+		{at: time.Unix(1_699_999_979, 999_999_999), want: 56666665}, // последний момент предыдущего окна
+		{at: time.Unix(1_699_999_980, 0), want: 56666666},           // начало окна
+		{period: Duration(45 * time.Second), at: time.Unix(1_700_000_000, 0), want: 37777777},
+		{period: Duration(time.Second), at: time.Unix(59, 500_000_000), want: 59},
+	}
+
+	for _, tt := range tests {
+		o := &TOTPOptions{PortMin: 10000, PortMax: 20000, Period: tt.period}
+		if got := o.Window(tt.at); got != tt.want {
+			t.Errorf("период %v, момент %v: окно %d, ожидается %d", time.Duration(tt.period), tt.at.UTC(), got, tt.want)
+		}
+	}
+}
+
+func TestTOTPValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    TOTPOptions
+		wantErr bool
+	}{
+		{name: "по умолчанию", opts: TOTPOptions{PortMin: 10000, PortMax: 20000}},
+		{name: "период 2s", opts: TOTPOptions{PortMin: 10000, PortMax: 20000, Period: Duration(2 * time.Second)}},
+		{name: "период 1500ms", opts: TOTPOptions{PortMin: 10000, PortMax: 20000, Period: Duration(1500 * time.Millisecond)}, wantErr: true},
+		{name: "период 500ms", opts: TOTPOptions{PortMin: 10000, PortMax: 20000, Period: Duration(500 * time.Millisecond)}, wantErr: true},
+		{name: "длина 16", opts: TOTPOptions{PortMin: 10000, PortMax: 20000, Length: maxTOTPLength}},
+		{name: "длина 300", opts: TOTPOptions{PortMin: 10000, PortMax: 20000, Length: 300}, wantErr: true},
+		{name: "пустой диапазон", opts: TOTPOptions{PortMin: 20000, PortMax: 20000}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, ожидается ошибка: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
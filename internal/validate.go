@@ -0,0 +1,349 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigIssue описывает одну проблему конфигурации
+type ConfigIssue struct {
+	Line    int    // строка YAML (0 если неизвестна)
+	Path    string // путь к параметру, например targets[0].ports[1]
+	Message string
+}
+
+func (i ConfigIssue) String() string {
+	var b strings.Builder
+	if i.Line > 0 {
+		fmt.Fprintf(&b, "строка %d: ", i.Line)
+	}
+	if i.Path != "" {
+		b.WriteString(i.Path + ": ")
+	}
+	b.WriteString(i.Message)
+	return b.String()
+}
+
+// ValidationError содержит все проблемы, найденные при проверке конфигурации
+type ValidationError struct {
+	Issues []ConfigIssue
+}
+
+func (e *ValidationError) Error() string {
+	lines := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		lines[i] = "  " + issue.String()
+	}
+	return fmt.Sprintf("конфигурация содержит ошибки (%d):\n%s", len(e.Issues), strings.Join(lines, "\n"))
+}
+
+// ParseConfig разбирает YAML конфигурацию в строгом режиме (неизвестные параметры - ошибка)
+// и проверяет значения. Все найденные проблемы возвращаются вместе в *ValidationError
+func ParseConfig(data []byte) (*Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("не удалось разобрать YAML: %w", err)
+	}
+
+	v := &configValidator{root: &root}
+
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("не удалось разобрать YAML: %w", err)
+		}
+		for _, message := range typeErr.Errors {
+			v.addDecodeError(message)
+		}
+	}
+
+	v.validate(&config)
+	if len(v.issues) > 0 {
+		sort.SliceStable(v.issues, func(i, j int) bool { return v.issues[i].Line < v.issues[j].Line })
+		return &config, &ValidationError{Issues: v.issues}
+	}
+	return &config, nil
+}
+
+// configValidator собирает проблемы конфигурации, определяя строки по дереву YAML
+type configValidator struct {
+	root   *yaml.Node
+	issues []ConfigIssue
+}
+
+var (
+	decodeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+	unknownField    = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+)
+
+// addDecodeError добавляет ошибку строгого разбора yaml.v3 ("line N: ...")
+func (v *configValidator) addDecodeError(message string) {
+	issue := ConfigIssue{Message: message}
+	if match := decodeErrorLine.FindStringSubmatch(message); match != nil {
+		issue.Line, _ = strconv.Atoi(match[1])
+		issue.Message = match[2]
+	}
+	if match := unknownField.FindStringSubmatch(issue.Message); match != nil {
+		issue.Message = fmt.Sprintf("неизвестный параметр '%s'", match[1])
+	}
+	v.issues = append(v.issues, issue)
+}
+
+// addf добавляет проблему для параметра по пути из ключей и индексов
+func (v *configValidator) addf(path []any, format string, args ...any) {
+	v.issues = append(v.issues, ConfigIssue{
+		Line:    nodeLine(v.root, path...),
+		Path:    formatPath(path),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *configValidator) validate(config *Config) {
+	if config.Parallel < 0 {
+		v.addf([]any{"parallel"}, "значение не может быть отрицательным: %d", config.Parallel)
+	}
+	if len(config.Targets) == 0 {
+		v.addf([]any{"targets"}, "не задано ни одной цели")
+	}
+
+	names := make(map[string]int)
+	for i, target := range config.Targets {
+		at := func(steps ...any) []any { return append([]any{"targets", i}, steps...) }
+
+		if target.Name != "" {
+			if first, ok := names[target.Name]; ok {
+				v.addf(at("name"), "имя '%s' уже используется целью targets[%d]", target.Name, first)
+			} else {
+				names[target.Name] = i
+			}
+		}
+		if strings.TrimSpace(target.Host) == "" {
+			v.addf(at("host"), "не задан host")
+		}
+
+		protocol := strings.ToLower(target.Protocol)
+		switch protocol {
+		case "tcp", "udp", "icmp", "spa":
+		case "":
+			// Без протокола цели у каждого шага должен быть свой
+			if target.TOTP != nil || len(target.Ports) == 0 || slices.ContainsFunc(target.Ports, func(spec PortSpec) bool { return spec.Protocol == "" }) {
+				v.addf(at("protocol"), "не задан protocol (tcp, udp, icmp или spa) для шагов без собственного протокола")
+			}
+		default:
+			v.addf(at("protocol"), "неподдерживаемый протокол '%s', ожидается tcp, udp, icmp или spa", target.Protocol)
+		}
+		if target.ICMP != nil {
+			if err := target.ICMP.validate(); err != nil {
+				v.addf(at("icmp", "encode"), "%v", err)
+			}
+		}
+		icmpSize := target.ICMP.encoding() == ICMPEncodeSize
+
+		for j, spec := range target.Ports {
+			if spec.Port < 1 || spec.Port > 65535 {
+				v.addf(at("ports", j), "порт %d вне допустимого диапазона (1-65535)", spec.Port)
+			}
+			if spec.Protocol != "" && spec.Protocol != "tcp" && spec.Protocol != "udp" && spec.Protocol != "icmp" {
+				v.addf(at("ports", j), "неподдерживаемый протокол шага '%s', ожидается tcp, udp или icmp", spec.Protocol)
+			}
+			if icmpSize && target.stepProtocol(spec) == "icmp" {
+				if spec.Port > maxICMPSize {
+					v.addf(at("ports", j), "размер echo request %d больше допустимого (%d)", spec.Port, maxICMPSize)
+				}
+				if target.stepPayload(spec) != "" {
+					v.addf(at("ports", j), "при icmp.encode: size содержимое echo request задает шаг, payload не используется")
+				}
+			}
+			if spec.Delay != nil {
+				v.checkDuration(at("ports", j, "delay"), *spec.Delay)
+			}
+			if spec.Payload != "" {
+				v.checkPayload(at("ports", j, "payload"), spec.Payload, protocol)
+			}
+			if spec.SourcePort < 0 || spec.SourcePort > 65535 {
+				v.addf(at("ports", j, "source_port"), "порт %d вне допустимого диапазона (0-65535)", spec.SourcePort)
+			}
+			if spec.SourcePort != 0 && target.SameSourcePort {
+				v.addf(at("ports", j, "source_port"), "при same_source_port порт источника задается для всей последовательности")
+			}
+			if spec.Protocol != "" && protocol == "spa" {
+				v.addf(at("ports", j), "для spa протокол шага не задается")
+			}
+		}
+		switch {
+		case target.TOTP != nil && len(target.Ports) > 0:
+			v.addf(at("totp"), "ports и totp нельзя задавать одновременно")
+		case protocol == "spa" && len(target.Ports) > 1:
+			v.addf(at("ports"), "для spa задается не больше одного порта")
+		case target.TOTP == nil && protocol != "spa" && len(target.Ports) == 0:
+			v.addf(at("ports"), "не задан ни один порт")
+		}
+		if target.TOTP != nil {
+			if err := target.TOTP.validate(); err != nil {
+				v.addf(at("totp"), "%v", err)
+			}
+		}
+
+		v.checkDuration(at("delay"), target.Delay)
+		v.checkDuration(at("jitter"), target.Jitter)
+		if target.Payload != "" {
+			v.checkPayload(at("payload"), target.Payload, protocol)
+		}
+		v.checkDuration(at("retry_backoff"), target.RetryBackoff)
+		if target.Retries < 0 {
+			v.addf(at("retries"), "значение не может быть отрицательным: %d", target.Retries)
+		}
+
+		if raw := target.Raw; raw != nil {
+			if err := raw.validate(); err != nil {
+				v.addf(at("raw"), "%v", err)
+			}
+			if target.WaitConnection {
+				v.addf(at("raw"), "raw сегмент не устанавливает соединение, wait_connection с ним не используется")
+			}
+			if protocol == "spa" {
+				v.addf(at("raw"), "raw используется только для tcp шагов")
+			}
+		}
+
+		if target.SourceAddress != "" && net.ParseIP(target.SourceAddress) == nil {
+			v.addf(at("source_address"), "неверный адрес '%s', ожидается IP", target.SourceAddress)
+		}
+		if target.SourcePort < 0 || target.SourcePort > 65535 {
+			v.addf(at("source_port"), "порт %d вне допустимого диапазона (0-65535)", target.SourcePort)
+		}
+		switch strings.ToLower(target.IPVersion) {
+		case "", "any", "4", "6", "ipv4", "ipv6":
+		default:
+			v.addf(at("ip_version"), "неверная версия IP '%s', ожидается 4, 6 или any", target.IPVersion)
+		}
+		if target.Gateway != "" {
+			v.checkGateway(at("gateway"), target.Gateway)
+			if target.WaitConnection {
+				v.addf(at("gateway"), "пакеты через шлюз не устанавливают соединение, wait_connection с ним не используется (адрес источника задается source_address)")
+			}
+		}
+
+		if verify := target.Verify; verify != nil {
+			if verify.Port < 1 || verify.Port > 65535 {
+				v.addf(at("verify", "port"), "порт %d вне допустимого диапазона (1-65535)", verify.Port)
+			}
+			if p := strings.ToLower(verify.Protocol); p != "" && p != "tcp" && p != "udp" {
+				v.addf(at("verify", "protocol"), "неподдерживаемый протокол проверки '%s', ожидается tcp или udp", verify.Protocol)
+			}
+			if verify.Retries != nil && *verify.Retries < 0 {
+				v.addf(at("verify", "retries"), "значение не может быть отрицательным: %d", *verify.Retries)
+			}
+			v.checkDuration(at("verify", "timeout"), verify.Timeout)
+			v.checkDuration(at("verify", "interval"), verify.Interval)
+		}
+
+		if serve := target.Serve; serve != nil {
+			switch serve.actionName() {
+			case ActionExec, ActionNftables, ActionIptables:
+			default:
+				v.addf(at("serve", "action"), "неизвестное действие '%s', ожидается exec, nftables или iptables", serve.Action)
+			}
+			v.checkDuration(at("serve", "sequence_timeout"), serve.SequenceTimeout)
+			v.checkDuration(at("serve", "close_after"), serve.CloseAfter)
+		}
+	}
+}
+
+func (v *configValidator) checkDuration(path []any, d Duration) {
+	if d < 0 {
+		v.addf(path, "длительность не может быть отрицательной: %v", time.Duration(d))
+	}
+}
+
+func (v *configValidator) checkPayload(path []any, payload, protocol string) {
+	if protocol == "spa" {
+		v.addf(path, "для spa payload не задается: содержимое пакета формирует протокол fwknop")
+		return
+	}
+	if err := checkPayload(payload); err != nil {
+		v.addf(path, "%v", err)
+	}
+}
+
+// checkGateway проверяет, что шлюз задан как IP или IP:порт и находится в сети одного из локальных
+// интерфейсов. Порт указывается только в прежней форме gateway с локальным адресом
+func (v *configValidator) checkGateway(path []any, gateway string) {
+	ip, port, err := parseGateway(gateway)
+	if err != nil {
+		v.addf(path, "неверный адрес '%s', ожидается IP или IP:порт", gateway)
+		return
+	}
+	_, _, local, err := gatewayInterface(ip)
+	switch {
+	case err != nil:
+		v.addf(path, "%v (адрес источника задается source_address)", err)
+	case port != 0 && !local:
+		v.addf(path, "у шлюза %s не указывается порт: порт источника задается source_port", ip)
+	}
+}
+
+// nodeLine возвращает строку узла по пути из ключей и индексов; если путь найден
+// не целиком (параметр не задан), возвращается строка ближайшего родителя
+func nodeLine(node *yaml.Node, path ...any) int {
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, step := range path {
+		next := childNode(node, step)
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return node.Line
+}
+
+func childNode(node *yaml.Node, step any) *yaml.Node {
+	switch key := step.(type) {
+	case string:
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					return node.Content[i+1]
+				}
+			}
+		}
+	case int:
+		if node.Kind == yaml.SequenceNode && key < len(node.Content) {
+			return node.Content[key]
+		}
+	}
+	return nil
+}
+
+// formatPath записывает путь в виде targets[0].ports[1]
+func formatPath(path []any) string {
+	var b strings.Builder
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(key)
+		case int:
+			fmt.Fprintf(&b, "[%d]", key)
+		}
+	}
+	return b.String()
+}
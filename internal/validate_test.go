@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseConfigGateway(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("сеть 127.0.0.0/8 на lo есть только в Linux")
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		wantErr string // пусто - конфигурация корректна
+	}{
+		{name: "следующий узел", target: `gateway: "127.0.0.9"`},
+		{name: "прежняя форма с портом", target: `gateway: "127.0.0.1:40000"`},
+		{name: "порт у нелокального шлюза", target: `gateway: "127.0.0.9:40000"`, wantErr: "не указывается порт"},
+		{name: "вне локальных сетей", target: `gateway: "198.51.100.254"`, wantErr: "не находится в сети"},
+		{name: "wait_connection", target: "gateway: \"127.0.0.1:40000\"\n    wait_connection: true", wantErr: "wait_connection"},
+		{name: "неверный адрес", target: `gateway: "router"`, wantErr: "ожидается IP или IP:порт"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "targets:\n  - host: \"127.0.0.1\"\n    protocol: tcp\n    ports: [7000]\n    " + tt.target + "\n"
+			_, err := ParseConfig([]byte(data))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ошибка %v, ожидается содержащая %q", err, tt.wantErr)
+			}
+		})
+	}
+}
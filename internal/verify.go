@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVerifyTimeout  = 3 * time.Second
+	defaultVerifyInterval = time.Second
+	defaultVerifyRetries  = 3
+	maxBannerSize         = 512
+)
+
+// VerifyOptions описывает проверку того, что защищенный порт открылся после последовательности
+type VerifyOptions struct {
+	Host     string   `yaml:"host,omitempty"`     // проверяемый хост (по умолчанию host цели)
+	Port     int      `yaml:"port"`               // проверяемый порт, например 22
+	Protocol string   `yaml:"protocol,omitempty"` // tcp (по умолчанию) или udp - для udp нужен ответ сервиса
+	Timeout  Duration `yaml:"timeout,omitempty"`  // таймаут одной попытки (по умолчанию 3s)
+	Retries  *int     `yaml:"retries,omitempty"`  // сколько раз повторить неудачную попытку (по умолчанию 3, 0 - без повторов)
+	Interval Duration `yaml:"interval,omitempty"` // пауза между попытками (по умолчанию 1s)
+	Banner   string   `yaml:"banner,omitempty"`   // ожидаемая строка в приветствии сервиса, например "SSH-2.0"
+}
+
+// VerifyResult содержит результат проверки доступности после последовательности
+type VerifyResult struct {
+	Address    string
+	Protocol   string
+	Attempts   int
+	Reachable  bool
+	Banner     string // начало полученного приветствия
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Err        error // ошибка последней попытки
+}
+
+// verifyTarget проверяет, что после последовательности сервис стал доступен
+func (pk *PortKnocker) verifyTarget(ctx context.Context, target Target, verbose bool) *VerifyResult {
+	opts := target.Verify
+	host := opts.Host
+	if host == "" {
+		host = target.Host
+	}
+	protocol := strings.ToLower(opts.Protocol)
+	if protocol == "" {
+		protocol = "tcp"
+	}
+	timeout := time.Duration(opts.Timeout)
+	if timeout <= 0 {
+		timeout = defaultVerifyTimeout
+	}
+	interval := time.Duration(opts.Interval)
+	if interval <= 0 {
+		interval = defaultVerifyInterval
+	}
+	retries := defaultVerifyRetries
+	if opts.Retries != nil {
+		retries = *opts.Retries
+	}
+
+	result := &VerifyResult{
+		Address:   net.JoinHostPort(host, strconv.Itoa(opts.Port)),
+		Protocol:  protocol,
+		StartedAt: time.Now(),
+	}
+	defer func() { result.FinishedAt = time.Now() }()
+
+	if protocol != "tcp" && protocol != "udp" {
+		result.Err = fmt.Errorf("неподдерживаемый протокол проверки: %s", opts.Protocol)
+		return result
+	}
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, interval); err != nil {
+				result.Err = err
+				return result
+			}
+		}
+
+		result.Attempts++
+		if verbose {
+			pk.printf("  Проверка %s/%s (попытка %d/%d)\n", result.Address, protocol, attempt+1, retries+1)
+		}
+
+		banner, err := probe(ctx, protocol, target.network(protocol), result.Address, timeout, opts.Banner)
+		result.Banner = banner
+		result.Err = err
+		if err == nil {
+			result.Reachable = true
+			if verbose {
+				pk.printf("  Порт %s доступен\n", result.Address)
+			}
+			return result
+		}
+		if verbose {
+			pk.printf("  Порт %s недоступен: %v\n", result.Address, err)
+		}
+	}
+
+	return result
+}
+
+// probe выполняет одну попытку проверки. Для TCP достаточно установить соединение (и получить
+// banner, если он задан), для UDP нужен любой ответ сервиса на пустую датаграмму.
+// network - сеть dialer с версией IP ("tcp", "tcp6")
+func probe(ctx context.Context, protocol, network, address string, timeout time.Duration, banner string) (string, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if protocol == "tcp" && banner == "" {
+		return "", nil
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if protocol == "udp" {
+		if _, err := conn.Write([]byte{}); err != nil {
+			return "", err
+		}
+	}
+
+	// Читаем, пока не встретится ожидаемая строка, или до таймаута
+	buf := make([]byte, maxBannerSize)
+	received := 0
+	for received < len(buf) {
+		n, err := conn.Read(buf[received:])
+		received += n
+		if banner == "" && received > 0 || banner != "" && strings.Contains(string(buf[:received]), banner) {
+			return printableBanner(buf[:received]), nil
+		}
+		if err != nil {
+			if received > 0 {
+				return printableBanner(buf[:received]), fmt.Errorf("в ответе нет ожидаемой строки %q", banner)
+			}
+			return "", err
+		}
+		if protocol == "udp" {
+			break // каждая датаграмма - отдельный ответ
+		}
+	}
+
+	return printableBanner(buf[:received]), fmt.Errorf("в ответе нет ожидаемой строки %q", banner)
+}
+
+// printableBanner возвращает первую строку ответа для отчета
+func printableBanner(data []byte) string {
+	line, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSpace(strings.ToValidUTF8(line, "?"))
+}
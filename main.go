@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -15,6 +16,11 @@ var (
 
 func main() {
 	if err := cmd.Execute(); err != nil {
+		// Код возврата команды --exec/exec передается как есть
+		var exitErr *cmd.ExitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
 		fmt.Fprintf(os.Stderr, "Ошибка: %v\n", err)
 		os.Exit(1)
 	}